@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yeya24/exemplars-storage/pkg/importer/promwal"
+	"github.com/yeya24/exemplars-storage/pkg/importer/remotewrite"
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
+)
+
+const importUsage = `usage: %s import prometheus-wal --dir=<wal dir> [flags]
+
+Imports the exemplars recorded in the WAL of a Prometheus server.
+
+`
+
+// runImport runs the import subcommand with the arguments following it.
+func runImport(logger log.Logger, args []string) error {
+	if len(args) == 0 || args[0] != "prometheus-wal" {
+		fmt.Fprintf(os.Stderr, importUsage, os.Args[0])
+		return errors.New("unknown import source, supported: prometheus-wal")
+	}
+
+	fs := flag.NewFlagSet("import prometheus-wal", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), importUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	dir := fs.String("dir", "", "Prometheus WAL directory, usually <storage.tsdb.path>/wal.")
+	follow := fs.Bool("follow", false, "Keep tailing the WAL for new segments after importing the existing ones, to run as a Prometheus sidecar. Use with --remote-write.url to feed a running server.")
+	pollInterval := fs.Duration("poll-interval", 5*time.Second, "How often to check the WAL for new records in follow mode.")
+	batchSize := fs.Int("batch-size", 10000, "Number of exemplars appended at once.")
+	tenant := fs.String("tenant", tenancy.DefaultTenant, "Tenant to import the exemplars for.")
+	stateFile := fs.String("state-file", "", "File the timestamp of the newest imported exemplar of every series is kept in, so exemplars imported by earlier runs are skipped. Defaults to prometheus-wal-import.state in --storage.data-dir.")
+	remoteWriteURL := fs.String("remote-write.url", "", "Remote write endpoint of a running server to send the exemplars to, like http://localhost:8081/api/v1/write. The store configured by the storage flags is opened if not set, which must not be in use by a server.")
+	tenantHeader := fs.String("remote-write.tenant-header", tenancy.DefaultTenantHeader, "Header the tenant is sent in with --remote-write.url.")
+	sf := registerStorageFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *dir == "" {
+		fs.Usage()
+		return errors.New("--dir is required")
+	}
+	if err := tenancy.ValidateTenant(*tenant); err != nil {
+		return err
+	}
+
+	if *stateFile == "" {
+		*stateFile = filepath.Join(*sf.dataDir, "prometheus-wal-import.state")
+	}
+
+	var appender storage.ExemplarAppender
+	closeAppender := func() error { return nil }
+	if *remoteWriteURL != "" {
+		appender = remotewrite.NewClient(http.DefaultClient, *remoteWriteURL, *tenantHeader)
+	} else {
+		store, err := sf.newStore(logger, trace.NewNoopTracerProvider().Tracer(""), prometheus.NewRegistry())
+		if err != nil {
+			return err
+		}
+		appender, closeAppender = store, store.Close
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	ctx = tenancy.InjectTenant(ctx, *tenant)
+
+	importer := promwal.NewImporter(log.With(logger, "component", "importer"), appender, *dir, promwal.Options{
+		BatchSize:    *batchSize,
+		PollInterval: *pollInterval,
+		Retention:    *sf.retention,
+		StateFile:    *stateFile,
+	})
+	err := importer.Run(ctx, *follow)
+	// Closing the store persists the exemplars of the last batches.
+	if cerr := closeAppender(); cerr != nil && err == nil {
+		err = errors.Wrap(cerr, "close store")
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	level.Info(logger).Log("msg", "import finished")
+	return nil
+}
@@ -26,7 +26,8 @@ import (
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/yeya24/exemplars-storage/pkg/server"
-	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
 )
 
 // A lot of code copy-pasted from https://github.com/thanos-io/thanos/blob/main/cmd/thanos/main.go.
@@ -36,9 +37,25 @@ type ExemplarsComponent struct{}
 func (c ExemplarsComponent) String() string { return "exemplars-store" }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+		if err := runImport(logger, os.Args[2:]); err != nil {
+			level.Error(logger).Log("err", fmt.Sprintf("%+v", err))
+			os.Exit(1)
+		}
+		return
+	}
+
 	httpAddr := flag.String("http-address", ":10902", "Listen host:port for HTTP endpoints.")
 	grpcAddr := flag.String("grpc-address", ":10901", "Listen ip:port address for gRPC endpoints (StoreAPI). Make sure this address is routable from other components.")
+	tenantHeader := flag.String("tenant-header", tenancy.DefaultTenantHeader, "HTTP header and gRPC metadata key to read the tenant of a request from, for example X-Scope-OrgID. Requests without it are stored for the default tenant.")
+	traceIDLabel := flag.String("query.trace-id-label", "trace_id", "Exemplar label holding the trace ID, used to look up the exemplars of a trace.")
+	maxSeries := flag.Int("query.max-series", 0, "Maximum number of series an exemplar query may return, unlimited if 0.")
+	maxExemplars := flag.Int("query.max-exemplars", 0, "Maximum number of exemplars an exemplar query may return, unlimited if 0.")
+	maxBytes := flag.Int64("query.max-bytes", 0, "Maximum estimated size in bytes of the labels and exemplars an exemplar query may return, unlimited if 0.")
+	truncateOnLimit := flag.Bool("query.truncate-on-limit", false, "Return the exemplars selected until a query limit is reached with a warning, instead of failing the query.")
 	enableThanos := flag.Bool("thanos", false, "Use exemplars storage in Thanos. Make it a Thanos Store and serve Info and Exemplars Requests via gRPC.")
+	sf := registerStorageFlags(flag.CommandLine)
 
 	flag.Parse()
 	reg := prometheus.NewRegistry()
@@ -49,11 +66,23 @@ func main() {
 	)
 	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
 	tracer := trace.NewNoopTracerProvider().Tracer("")
-	store, err := storage.NewExemplarStore(logger, tracer, reg, storage.FrostDBExemplarStore)
+	store, err := sf.newStore(logger, tracer, reg)
 	if err != nil {
+		level.Error(logger).Log("msg", "failed to create exemplar store", "err", err)
 		os.Exit(1)
 	}
-	es := server.NewExemplarServer(logger, reg, store)
+	defer store.Close()
+	es := server.NewExemplarServer(logger, reg, store,
+		server.WithTenantHeader(*tenantHeader),
+		server.WithTraceIDLabel(*traceIDLabel),
+		server.WithRetention(*sf.retention),
+		server.WithQueryLimits(model.Limits{
+			MaxSeries:    *maxSeries,
+			MaxExemplars: *maxExemplars,
+			MaxBytes:     *maxBytes,
+			Truncate:     *truncateOnLimit,
+		}),
+	)
 
 	comp := ExemplarsComponent{}
 
@@ -0,0 +1,318 @@
+// Package promwal imports exemplars from the write-ahead log of a Prometheus
+// server. Prometheus keeps exemplars only in a circular in-memory buffer,
+// but records them in its WAL alongside the series they belong to.
+package promwal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wlog"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+)
+
+// Options configures an Importer.
+type Options struct {
+	// BatchSize is the number of exemplars appended at once.
+	BatchSize int
+	// PollInterval is how often the WAL is checked for new records in
+	// follow mode.
+	PollInterval time.Duration
+	// Retention is how long the store keeps exemplars, older ones are
+	// skipped. None are skipped if 0.
+	Retention time.Duration
+	// StateFile keeps the timestamp of the newest imported exemplar of every
+	// series across runs. Not kept if empty.
+	StateFile string
+}
+
+// Importer reads the checkpoint and segments of a WAL directory and appends
+// the exemplars found in them. Exemplars at or before the newest imported
+// exemplar of their series are skipped, as the checkpoint repeats the
+// exemplars of the segments it replaced.
+type Importer struct {
+	logger   log.Logger
+	appender storage.ExemplarAppender
+	dir      string
+	opts     Options
+
+	dec    record.Decoder
+	series map[chunks.HeadSeriesRef]labels.Labels
+	batch  map[chunks.HeadSeriesRef][]exemplar.Exemplar
+	// batched is the number of exemplars in batch.
+	batched int
+	// newest is the timestamp of the newest imported exemplar by series
+	// labels hash.
+	newest map[uint64]int64
+
+	imported, skipped, duplicates int
+}
+
+// NewImporter creates an importer reading the WAL in dir.
+func NewImporter(logger log.Logger, appender storage.ExemplarAppender, dir string, opts Options) *Importer {
+	return &Importer{
+		logger:   logger,
+		appender: appender,
+		dir:      dir,
+		opts:     opts,
+		series:   map[chunks.HeadSeriesRef]labels.Labels{},
+		batch:    map[chunks.HeadSeriesRef][]exemplar.Exemplar{},
+		newest:   map[uint64]int64{},
+	}
+}
+
+// Run imports the last checkpoint and all segments after it. If follow is
+// true, Run keeps tailing the WAL for new segments until ctx is canceled.
+func (i *Importer) Run(ctx context.Context, follow bool) error {
+	if i.opts.StateFile != "" {
+		newest, err := readState(i.opts.StateFile)
+		if err != nil {
+			return err
+		}
+		i.newest = newest
+	}
+
+	segment, err := i.importCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		_, last, err := wlog.Segments(i.dir)
+		if err != nil {
+			return errors.Wrap(err, "list segments")
+		}
+		if segment > last {
+			if !follow {
+				break
+			}
+			// Wait for Prometheus to create the next segment.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(i.opts.PollInterval):
+			}
+			continue
+		}
+
+		err = i.importSegment(ctx, segment, follow)
+		if os.IsNotExist(errors.Cause(err)) {
+			// Prometheus truncated the WAL before we got to the segment,
+			// continue with the checkpoint that replaced it.
+			level.Warn(i.logger).Log("msg", "segment was removed, restarting from the last checkpoint", "segment", segment)
+			if segment, err = i.importCheckpoint(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		segment++
+	}
+
+	level.Info(i.logger).Log("msg", "imported exemplars from WAL", "imported", i.imported, "skipped", i.skipped, "duplicates", i.duplicates)
+	return nil
+}
+
+// importCheckpoint imports the last checkpoint if there is one and returns
+// the first segment after it.
+func (i *Importer) importCheckpoint(ctx context.Context) (int, error) {
+	dir, idx, err := wlog.LastCheckpoint(i.dir)
+	if errors.Is(err, record.ErrNotFound) {
+		first, _, err := wlog.Segments(i.dir)
+		if err != nil {
+			return 0, errors.Wrap(err, "list segments")
+		}
+		if first < 0 {
+			first = 0
+		}
+		return first, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "find last checkpoint")
+	}
+
+	sr, err := wlog.NewSegmentsReader(dir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "open checkpoint %s", dir)
+	}
+	defer sr.Close()
+
+	level.Info(i.logger).Log("msg", "importing checkpoint", "dir", dir)
+	if err := i.readRecords(ctx, wlog.NewReader(sr)); err != nil {
+		return 0, errors.Wrapf(err, "read checkpoint %s", dir)
+	}
+	if err := i.flush(ctx); err != nil {
+		return 0, err
+	}
+	return idx + 1, nil
+}
+
+// importSegment imports a single segment. In follow mode, it keeps reading
+// the segment until Prometheus moved on to the next one.
+func (i *Importer) importSegment(ctx context.Context, segment int, follow bool) error {
+	s, err := wlog.OpenReadSegment(wlog.SegmentName(i.dir, segment))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	level.Debug(i.logger).Log("msg", "importing segment", "segment", segment)
+	r := wlog.NewLiveReader(i.logger, nil, s)
+	if !follow {
+		if err := i.readRecords(ctx, r); err != nil {
+			return errors.Wrapf(err, "read segment %d", segment)
+		}
+		return i.flush(ctx)
+	}
+
+	ticker := time.NewTicker(i.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := i.readRecords(ctx, r); err != nil {
+			return errors.Wrapf(err, "read segment %d", segment)
+		}
+		if err := i.flush(ctx); err != nil {
+			return err
+		}
+
+		_, last, err := wlog.Segments(i.dir)
+		if err != nil {
+			return errors.Wrap(err, "list segments")
+		}
+		if last > segment {
+			// A newer segment exists, so this one is complete. Read the
+			// records written since the last read before moving on.
+			if err := i.readRecords(ctx, r); err != nil {
+				return errors.Wrapf(err, "read segment %d", segment)
+			}
+			return i.flush(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordReader is implemented by wlog.Reader and wlog.LiveReader.
+type recordReader interface {
+	Next() bool
+	Record() []byte
+	Err() error
+}
+
+// readRecords reads all records currently available from r.
+func (i *Importer) readRecords(ctx context.Context, r recordReader) error {
+	var (
+		series    []record.RefSeries
+		exemplars []record.RefExemplar
+		err       error
+	)
+	for r.Next() {
+		rec := r.Record()
+		switch i.dec.Type(rec) {
+		case record.Series:
+			series, err = i.dec.Series(rec, series[:0])
+			if err != nil {
+				return errors.Wrap(err, "decode series")
+			}
+			for _, s := range series {
+				i.series[s.Ref] = s.Labels
+			}
+		case record.Exemplars:
+			exemplars, err = i.dec.Exemplars(rec, exemplars[:0])
+			if err != nil {
+				return errors.Wrap(err, "decode exemplars")
+			}
+			for _, e := range exemplars {
+				i.add(e)
+			}
+			if i.batched >= i.opts.BatchSize {
+				if err := i.flush(ctx); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := r.Err(); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (i *Importer) add(e record.RefExemplar) {
+	lset, ok := i.series[e.Ref]
+	if !ok {
+		level.Debug(i.logger).Log("msg", "skipping exemplar of unknown series", "ref", e.Ref)
+		i.skipped++
+		return
+	}
+	ex := exemplar.Exemplar{
+		Labels: e.Labels,
+		Value:  e.V,
+		Ts:     e.T,
+		HasTs:  true,
+	}
+	h := lset.Hash()
+	if newest, ok := i.newest[h]; ok && e.T <= newest {
+		i.duplicates++
+		return
+	}
+	if err := storage.ValidateExemplar(lset, ex, storage.MinValidTime(time.Now(), i.opts.Retention)); err != nil {
+		level.Debug(i.logger).Log("msg", "skipping invalid exemplar", "series", lset.String(), "err", err)
+		i.skipped++
+		return
+	}
+	i.batch[e.Ref] = append(i.batch[e.Ref], ex)
+	i.batched++
+	i.newest[h] = e.T
+}
+
+// flush appends all batched exemplars.
+func (i *Importer) flush(ctx context.Context) error {
+	if i.batched == 0 {
+		return nil
+	}
+	series := make([]model.SeriesExemplars, 0, len(i.batch))
+	for ref, exemplars := range i.batch {
+		series = append(series, model.SeriesExemplars{
+			Labels:    i.series[ref],
+			Exemplars: exemplars,
+		})
+	}
+	rejected := 0
+	if err := i.appender.AppendExemplars(ctx, series); err != nil {
+		var perr *model.PartialAppendError
+		if !errors.As(err, &perr) {
+			return fmt.Errorf("append %d exemplars: %w", i.batched, err)
+		}
+		level.Debug(i.logger).Log("msg", "store rejected exemplars", "err", err)
+		rejected = perr.NumRejected()
+	}
+
+	i.imported += i.batched - rejected
+	i.skipped += rejected
+	i.batch = map[chunks.HeadSeriesRef][]exemplar.Exemplar{}
+	i.batched = 0
+
+	if i.opts.StateFile == "" {
+		return nil
+	}
+	return writeState(i.opts.StateFile, i.newest)
+}
@@ -0,0 +1,108 @@
+package promwal
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wlog"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+)
+
+// recordingAppender records the timestamps of the appended exemplars by
+// series.
+type recordingAppender map[string][]int64
+
+func (a recordingAppender) AppendExemplar(ctx context.Context, lset labels.Labels, e exemplar.Exemplar) error {
+	return a.AppendExemplars(ctx, []model.SeriesExemplars{{Labels: lset, Exemplars: []exemplar.Exemplar{e}}})
+}
+
+func (a recordingAppender) AppendExemplars(_ context.Context, series []model.SeriesExemplars) error {
+	for _, ss := range series {
+		for _, e := range ss.Exemplars {
+			a[ss.Labels.String()] = append(a[ss.Labels.String()], e.Ts)
+		}
+	}
+	return nil
+}
+
+func logRecords(t *testing.T, w *wlog.WL, recs ...[]byte) {
+	t.Helper()
+	if err := w.Log(recs...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImporter(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w, err := wlog.New(nil, nil, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var enc record.Encoder
+	exemplars := func(ref chunks.HeadSeriesRef, ts ...int64) []byte {
+		var exemplars []record.RefExemplar
+		for _, t := range ts {
+			exemplars = append(exemplars, record.RefExemplar{Ref: ref, T: t, V: 1, Labels: labels.FromStrings("trace_id", fmt.Sprint(t))})
+		}
+		return enc.Exemplars(exemplars, nil)
+	}
+	a1, a2 := labels.FromStrings("__name__", "foo", "a", "1"), labels.FromStrings("__name__", "foo", "a", "2")
+
+	logRecords(t, w,
+		enc.Series([]record.RefSeries{{Ref: 1, Labels: a1}, {Ref: 2, Labels: a2}}, nil),
+		exemplars(1, 1000, 2000),
+		exemplars(2, 1500),
+		// Exemplars of unknown series are skipped.
+		exemplars(3, 1000),
+	)
+	if _, err := w.NextSegment(); err != nil {
+		t.Fatal(err)
+	}
+	logRecords(t, w, exemplars(1, 3000))
+
+	opts := Options{BatchSize: 2, StateFile: filepath.Join(t.TempDir(), "state")}
+	run := func(t *testing.T, want recordingAppender) {
+		t.Helper()
+		got := recordingAppender{}
+		if err := NewImporter(log.NewNopLogger(), got, dir, opts).Run(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("imported %v, want %v", got, want)
+		}
+	}
+
+	t.Run("import", func(t *testing.T) {
+		run(t, recordingAppender{a1.String(): {1000, 2000, 3000}, a2.String(): {1500}})
+	})
+	t.Run("already imported", func(t *testing.T) {
+		run(t, recordingAppender{})
+	})
+	t.Run("checkpoint", func(t *testing.T) {
+		logRecords(t, w, exemplars(2, 2500))
+		// The checkpoint repeats the exemplars of the first segment, which
+		// was imported already.
+		if _, err := wlog.Checkpoint(log.NewNopLogger(), w, 0, 0, func(chunks.HeadSeriesRef) bool { return true }, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Truncate(1); err != nil {
+			t.Fatal(err)
+		}
+		run(t, recordingAppender{a2.String(): {2500}})
+	})
+	t.Run("without state", func(t *testing.T) {
+		opts.StateFile = ""
+		run(t, recordingAppender{a1.String(): {1000, 2000, 3000}, a2.String(): {1500, 2500}})
+	})
+}
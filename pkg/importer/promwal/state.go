@@ -0,0 +1,53 @@
+package promwal
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// stateEntrySize is the size of a state entry, the series labels hash and
+// the timestamp of its newest imported exemplar.
+const stateEntrySize = 16
+
+// readState reads the timestamps of the newest imported exemplars by series
+// labels hash from file. The state is empty if file doesn't exist.
+func readState(file string) (map[uint64]int64, error) {
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return map[uint64]int64{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read state")
+	}
+	if len(b)%stateEntrySize != 0 {
+		return nil, errors.Errorf("corrupted state file %s", file)
+	}
+
+	newest := make(map[uint64]int64, len(b)/stateEntrySize)
+	for ; len(b) > 0; b = b[stateEntrySize:] {
+		newest[binary.LittleEndian.Uint64(b)] = int64(binary.LittleEndian.Uint64(b[8:]))
+	}
+	return newest, nil
+}
+
+// writeState replaces file with the given state. It is written to a
+// temporary file first, so file is never left partially written.
+func writeState(file string, newest map[uint64]int64) error {
+	b := make([]byte, 0, len(newest)*stateEntrySize)
+	for h, ts := range newest {
+		b = binary.LittleEndian.AppendUint64(b, h)
+		b = binary.LittleEndian.AppendUint64(b, uint64(ts))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return errors.Wrap(err, "create state directory")
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return errors.Wrap(err, "write state")
+	}
+	return errors.Wrap(os.Rename(tmp, file), "write state")
+}
@@ -0,0 +1,115 @@
+// Package remotewrite appends exemplars to a running exemplars-storage
+// server with Prometheus remote write, so importers can feed the server
+// instead of opening its store.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
+)
+
+const (
+	remoteWriteVersionHeader = "X-Prometheus-Remote-Write-Version"
+	exemplarsWrittenHeader   = "X-Prometheus-Remote-Write-Exemplars-Written"
+
+	// maxErrorBodySize limits how much of an error response is read.
+	maxErrorBodySize = 1024
+)
+
+// Client sends exemplars to the remote write endpoint of a server. The
+// tenant of the context is sent in the tenant header.
+type Client struct {
+	url          string
+	client       *http.Client
+	tenantHeader string
+}
+
+// NewClient creates a client writing to the remote write endpoint url.
+func NewClient(client *http.Client, url, tenantHeader string) *Client {
+	return &Client{
+		url:          url,
+		client:       client,
+		tenantHeader: tenantHeader,
+	}
+}
+
+func (c *Client) AppendExemplar(ctx context.Context, lset labels.Labels, e exemplar.Exemplar) error {
+	return c.AppendExemplars(ctx, []model.SeriesExemplars{{Labels: lset, Exemplars: []exemplar.Exemplar{e}}})
+}
+
+// AppendExemplars sends all exemplars with a single request. Exemplars the
+// server rejected are returned as a *model.PartialAppendError, as the server
+// reports how many of them it wrote.
+func (c *Client) AppendExemplars(ctx context.Context, series []model.SeriesExemplars) error {
+	req := &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(series))}
+	n := 0
+	for _, ss := range series {
+		ts := prompb.TimeSeries{
+			Labels:    labelsToLabelProtos(ss.Labels),
+			Exemplars: make([]prompb.Exemplar, 0, len(ss.Exemplars)),
+		}
+		for _, e := range ss.Exemplars {
+			ts.Exemplars = append(ts.Exemplars, prompb.Exemplar{
+				Labels:    labelsToLabelProtos(e.Labels),
+				Value:     e.Value,
+				Timestamp: e.Ts,
+			})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+		n += len(ss.Exemplars)
+	}
+	b, err := req.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "marshal write request")
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(snappy.Encode(nil, b)))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set(remoteWriteVersionHeader, "0.1.0")
+	httpReq.Header.Set(c.tenantHeader, tenancy.TenantFromContext(ctx))
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return errors.Wrap(err, "send write request")
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	// 4xx responses reject exemplars permanently, the others were written.
+	if resp.StatusCode/100 == 4 {
+		if written, err := strconv.Atoi(resp.Header.Get(exemplarsWrittenHeader)); err == nil {
+			return &model.PartialAppendError{Rejected: map[error]int{
+				errors.New(strings.TrimSpace(string(body))): n - written,
+			}}
+		}
+	}
+	return errors.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+func labelsToLabelProtos(lset labels.Labels) []prompb.Label {
+	result := make([]prompb.Label, 0, len(lset))
+	for _, l := range lset {
+		result = append(result, prompb.Label{Name: l.Name, Value: l.Value})
+	}
+	return result
+}
@@ -0,0 +1,80 @@
+package remotewrite
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/yeya24/exemplars-storage/pkg/server"
+	"github.com/yeya24/exemplars-storage/pkg/storage/memory"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
+)
+
+func TestClient(t *testing.T) {
+	store, err := memory.NewMemoryStore(log.NewNopLogger(), prometheus.NewRegistry(), memory.Options{MaxExemplars: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	srv := httptest.NewServer(server.NewExemplarServer(log.NewNopLogger(), prometheus.NewRegistry(), store).Mux)
+	defer srv.Close()
+
+	c := NewClient(srv.Client(), srv.URL+"/api/v1/write", tenancy.DefaultTenantHeader)
+	ctx := tenancy.InjectTenant(context.Background(), "team-a")
+	lset := labels.FromStrings("__name__", "foo")
+	traceID := labels.FromStrings("trace_id", "abc")
+
+	if err := c.AppendExemplars(ctx, []model.SeriesExemplars{{
+		Labels: lset,
+		Exemplars: []exemplar.Exemplar{
+			{Labels: traceID, Value: 1, Ts: 1000, HasTs: true},
+			{Labels: traceID, Value: 2, Ts: 2000, HasTs: true},
+		},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The memory store rejects the out of order exemplar.
+	err = c.AppendExemplars(ctx, []model.SeriesExemplars{{
+		Labels: lset,
+		Exemplars: []exemplar.Exemplar{
+			{Labels: traceID, Value: 3, Ts: 3000, HasTs: true},
+			{Labels: traceID, Value: 4, Ts: 500, HasTs: true},
+		},
+	}})
+	var perr *model.PartialAppendError
+	if !errors.As(err, &perr) || perr.NumRejected() != 1 {
+		t.Fatalf("got error %v, want one rejected exemplar", err)
+	}
+
+	res, _, err := store.Select(ctx, 0, math.MaxInt64, nil, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || len(res[0].Exemplars) != 3 {
+		t.Fatalf("got %v, want the 3 accepted exemplars of the tenant", res)
+	}
+}
+
+func TestClientServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "disk full", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.Client(), srv.URL, tenancy.DefaultTenantHeader)
+	err := c.AppendExemplar(context.Background(), labels.FromStrings("__name__", "foo"), exemplar.Exemplar{Ts: 1, HasTs: true})
+	var perr *model.PartialAppendError
+	if err == nil || errors.As(err, &perr) {
+		t.Fatalf("got error %v, want a failed append", err)
+	}
+}
@@ -0,0 +1,39 @@
+// Package objstore creates the bucket FrostDB persists its blocks to.
+package objstore
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/client"
+	"github.com/thanos-io/objstore/providers/filesystem"
+	"gopkg.in/yaml.v2"
+)
+
+// InMemory is a bucket provider keeping all objects in memory, in addition to
+// the providers supported by Thanos. Meant for testing only.
+const InMemory client.ObjProvider = "INMEMORY"
+
+const component = "exemplars-store"
+
+// NewBucket creates a bucket from its YAML configuration, in the same format
+// as Thanos' --objstore.config. Without a configuration, blocks are stored on
+// the filesystem in the blocks directory of dataDir.
+func NewBucket(logger log.Logger, confContentYaml []byte, reg prometheus.Registerer, dataDir string) (objstore.Bucket, error) {
+	if len(confContentYaml) == 0 {
+		return filesystem.NewBucket(filepath.Join(dataDir, "blocks"))
+	}
+
+	bucketConf := &client.BucketConfig{}
+	if err := yaml.Unmarshal(confContentYaml, bucketConf); err != nil {
+		return nil, errors.Wrap(err, "parsing config YAML file")
+	}
+	if strings.ToUpper(string(bucketConf.Type)) == string(InMemory) {
+		return objstore.NewPrefixedBucket(objstore.NewInMemBucket(), bucketConf.Prefix), nil
+	}
+	return client.NewBucket(logger, confContentYaml, reg, component)
+}
@@ -0,0 +1,181 @@
+// Package writev2 contains the subset of the Prometheus Remote Write 2.0
+// protocol (io.prometheus.write.v2.Request) needed to ingest exemplars.
+//
+// Only the fields relevant for exemplars are decoded, everything else is
+// skipped. See https://prometheus.io/docs/specs/remote_write_spec_2_0/.
+package writev2
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Request is a decoded io.prometheus.write.v2.Request.
+type Request struct {
+	// Symbols is the symbol table all label references point into.
+	Symbols    []string
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is a decoded io.prometheus.write.v2.TimeSeries. Samples,
+// histograms and metadata are skipped.
+type TimeSeries struct {
+	LabelsRefs []uint32
+	Exemplars  []Exemplar
+}
+
+// Exemplar is a decoded io.prometheus.write.v2.Exemplar.
+type Exemplar struct {
+	LabelsRefs []uint32
+	Value      float64
+	Timestamp  int64
+}
+
+// Labels resolves the given label references against the symbol table of the
+// request. References come in name/value pairs.
+func (r *Request) Labels(refs []uint32) (labels.Labels, error) {
+	if len(refs)%2 != 0 {
+		return nil, fmt.Errorf("invalid labels references: odd number of references %d", len(refs))
+	}
+	b := labels.ScratchBuilder{}
+	for i := 0; i < len(refs); i += 2 {
+		nameRef, valueRef := refs[i], refs[i+1]
+		if int(nameRef) >= len(r.Symbols) || int(valueRef) >= len(r.Symbols) {
+			return nil, fmt.Errorf("labels reference out of range of %d symbols", len(r.Symbols))
+		}
+		b.Add(r.Symbols[nameRef], r.Symbols[valueRef])
+	}
+	b.Sort()
+	return b.Labels(), nil
+}
+
+// Unmarshal decodes a protobuf encoded io.prometheus.write.v2.Request.
+func (r *Request) Unmarshal(b []byte) error {
+	*r = Request{}
+	return walk(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 4 && typ == protowire.BytesType:
+			r.Symbols = append(r.Symbols, string(v))
+		case num == 5 && typ == protowire.BytesType:
+			var ts TimeSeries
+			if err := ts.unmarshal(v); err != nil {
+				return fmt.Errorf("timeseries: %w", err)
+			}
+			r.Timeseries = append(r.Timeseries, ts)
+		}
+		return nil
+	})
+}
+
+func (ts *TimeSeries) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		var err error
+		switch num {
+		case 1:
+			ts.LabelsRefs, err = appendRefs(ts.LabelsRefs, typ, v)
+			if err != nil {
+				return fmt.Errorf("labels_refs: %w", err)
+			}
+		case 4:
+			if typ != protowire.BytesType {
+				return fmt.Errorf("exemplars: unexpected wire type %d", typ)
+			}
+			var e Exemplar
+			if err := e.unmarshal(v); err != nil {
+				return fmt.Errorf("exemplars: %w", err)
+			}
+			ts.Exemplars = append(ts.Exemplars, e)
+		}
+		return nil
+	})
+}
+
+func (e *Exemplar) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		var err error
+		switch num {
+		case 1:
+			e.LabelsRefs, err = appendRefs(e.LabelsRefs, typ, v)
+			if err != nil {
+				return fmt.Errorf("labels_refs: %w", err)
+			}
+		case 2:
+			if typ != protowire.Fixed64Type {
+				return fmt.Errorf("value: unexpected wire type %d", typ)
+			}
+			x, n := protowire.ConsumeFixed64(v)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			e.Value = math.Float64frombits(x)
+		case 3:
+			if typ != protowire.VarintType {
+				return fmt.Errorf("timestamp: unexpected wire type %d", typ)
+			}
+			x, n := protowire.ConsumeVarint(v)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			e.Timestamp = int64(x)
+		}
+		return nil
+	})
+}
+
+// appendRefs decodes a repeated uint32 field, which can be either packed or
+// sent as individual varints.
+func appendRefs(refs []uint32, typ protowire.Type, v []byte) ([]uint32, error) {
+	switch typ {
+	case protowire.VarintType:
+		x, n := protowire.ConsumeVarint(v)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		return append(refs, uint32(x)), nil
+	case protowire.BytesType:
+		for len(v) > 0 {
+			x, n := protowire.ConsumeVarint(v)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			refs = append(refs, uint32(x))
+			v = v[n:]
+		}
+		return refs, nil
+	default:
+		return nil, fmt.Errorf("unexpected wire type %d", typ)
+	}
+}
+
+// walk calls fn for every field of the message b. For length delimited fields
+// v is the field content, for all other types v starts at the field value.
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		v := b[:m]
+		if typ == protowire.BytesType {
+			var k int
+			v, k = protowire.ConsumeBytes(v)
+			if k < 0 {
+				return protowire.ParseError(k)
+			}
+		}
+		if err := fn(num, typ, v); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package writev2
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// upstreamFile describes the messages of io/prometheus/write/v2/types.proto
+// of the Prometheus repository, which isn't part of the Prometheus version
+// this module depends on. Histograms are cut down to a few fields, they are
+// skipped by the decoder.
+func upstreamFile(t *testing.T) protoreflect.FileDescriptor {
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(num),
+			Type:   typ.Enum(),
+			Label:  label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	const (
+		optional = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		repeated = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	)
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("io/prometheus/write/v2/types.proto"),
+		Package: proto.String("io.prometheus.write.v2"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Request"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("symbols", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING, repeated, ""),
+					field("timeseries", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".io.prometheus.write.v2.TimeSeries"),
+				},
+			},
+			{
+				Name: proto.String("TimeSeries"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("labels_refs", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT32, repeated, ""),
+					field("samples", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".io.prometheus.write.v2.Sample"),
+					field("histograms", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".io.prometheus.write.v2.Histogram"),
+					field("exemplars", 4, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".io.prometheus.write.v2.Exemplar"),
+					field("metadata", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, optional, ".io.prometheus.write.v2.Metadata"),
+					field("created_timestamp", 6, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+				},
+			},
+			{
+				Name: proto.String("Exemplar"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("labels_refs", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT32, repeated, ""),
+					field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, optional, ""),
+					field("timestamp", 3, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+				},
+			},
+			{
+				Name: proto.String("Sample"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("value", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, optional, ""),
+					field("timestamp", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+				},
+			},
+			{
+				Name: proto.String("Histogram"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("count_int", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64, optional, ""),
+					field("sum", 3, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, optional, ""),
+					field("schema", 4, descriptorpb.FieldDescriptorProto_TYPE_SINT32, optional, ""),
+					field("timestamp", 15, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+				},
+			},
+			{
+				Name: proto.String("Metadata"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("help_ref", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT32, optional, ""),
+					field("unit_ref", 4, descriptorpb.FieldDescriptorProto_TYPE_UINT32, optional, ""),
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+// message builds a message of the given type of file, setting the fields of
+// values. Lists and nested messages are given as []interface{} and
+// map[string]interface{}.
+func message(t *testing.T, file protoreflect.FileDescriptor, name string, values map[string]interface{}) *dynamicpb.Message {
+	md := file.Messages().ByName(protoreflect.Name(name))
+	m := dynamicpb.NewMessage(md)
+	for k, v := range values {
+		fd := md.Fields().ByName(protoreflect.Name(k))
+		if fd == nil {
+			t.Fatalf("no field %s in %s", k, name)
+		}
+		value := func(v interface{}) protoreflect.Value {
+			if nested, ok := v.(map[string]interface{}); ok {
+				return protoreflect.ValueOfMessage(message(t, file, string(fd.Message().Name()), nested))
+			}
+			return protoreflect.ValueOf(v)
+		}
+		if list, ok := v.([]interface{}); ok {
+			l := m.Mutable(fd).List()
+			for _, v := range list {
+				l.Append(value(v))
+			}
+			continue
+		}
+		m.Set(fd, value(v))
+	}
+	return m
+}
+
+func TestRequestUnmarshalUpstream(t *testing.T) {
+	file := upstreamFile(t)
+	req := message(t, file, "Request", map[string]interface{}{
+		"symbols": []interface{}{"", "__name__", "http_requests_total", "job", "api", "trace_id", "abc", "help", "weird\nvalue"},
+		"timeseries": []interface{}{
+			map[string]interface{}{
+				"labels_refs": []interface{}{uint32(1), uint32(2), uint32(3), uint32(4)},
+				"samples": []interface{}{
+					map[string]interface{}{"value": 1.0, "timestamp": int64(1000)},
+					map[string]interface{}{"value": 2.0, "timestamp": int64(2000)},
+				},
+				"exemplars": []interface{}{
+					map[string]interface{}{"labels_refs": []interface{}{uint32(5), uint32(6)}, "value": 0.5, "timestamp": int64(1000)},
+					// Exemplars without labels, timestamp and a zero value
+					// leave all fields unset.
+					map[string]interface{}{},
+					map[string]interface{}{"labels_refs": []interface{}{uint32(5), uint32(8)}, "value": math.Inf(1), "timestamp": int64(-1)},
+				},
+				"metadata":          map[string]interface{}{"help_ref": uint32(7)},
+				"created_timestamp": int64(500),
+			},
+			map[string]interface{}{
+				"labels_refs": []interface{}{uint32(1), uint32(2)},
+				"histograms": []interface{}{
+					map[string]interface{}{"count_int": uint64(3), "sum": 1.5, "schema": int32(-1), "timestamp": int64(1000)},
+				},
+			},
+		},
+	})
+	b, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Request
+	if err := got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	want := Request{
+		Symbols: []string{"", "__name__", "http_requests_total", "job", "api", "trace_id", "abc", "help", "weird\nvalue"},
+		Timeseries: []TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Exemplars: []Exemplar{
+					{LabelsRefs: []uint32{5, 6}, Value: 0.5, Timestamp: 1000},
+					{},
+					{LabelsRefs: []uint32{5, 8}, Value: math.Inf(1), Timestamp: -1},
+				},
+			},
+			{
+				LabelsRefs: []uint32{1, 2},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected request\n got: %+v\nwant: %+v", got, want)
+	}
+
+	lset, err := got.Labels(got.Timeseries[0].Exemplars[2].LabelsRefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := labels.FromStrings("trace_id", "weird\nvalue"); !labels.Equal(lset, want) {
+		t.Fatalf("unexpected exemplar labels %s, want %s", lset, want)
+	}
+}
+
+// TestRequestUnmarshalUnpackedRefs checks that label references sent as
+// individual varints, which proto parsers have to accept for packed fields,
+// are decoded.
+func TestRequestUnmarshalUnpackedRefs(t *testing.T) {
+	var ex []byte
+	for _, ref := range []uint64{0, 1} {
+		ex = protowire.AppendTag(ex, 1, protowire.VarintType)
+		ex = protowire.AppendVarint(ex, ref)
+	}
+	var ts []byte
+	ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, 0)
+	ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, 1)
+	ts = protowire.AppendTag(ts, 4, protowire.BytesType)
+	ts = protowire.AppendBytes(ts, ex)
+
+	var b []byte
+	for _, s := range []string{"a", "b"} {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendBytes(b, ts)
+
+	var req Request
+	if err := req.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	want := []TimeSeries{{LabelsRefs: []uint32{0, 1}, Exemplars: []Exemplar{{LabelsRefs: []uint32{0, 1}}}}}
+	if !reflect.DeepEqual(req.Timeseries, want) {
+		t.Fatalf("unexpected timeseries %+v, want %+v", req.Timeseries, want)
+	}
+}
+
+func TestRequestLabels(t *testing.T) {
+	req := Request{Symbols: []string{"", "b", "2", "a", "1"}}
+	for _, tc := range []struct {
+		name    string
+		refs    []uint32
+		want    labels.Labels
+		wantErr bool
+	}{
+		{name: "sorted", refs: []uint32{1, 2, 3, 4}, want: labels.FromStrings("a", "1", "b", "2")},
+		{name: "empty", refs: nil, want: labels.EmptyLabels()},
+		{name: "odd", refs: []uint32{1}, wantErr: true},
+		{name: "out of range", refs: []uint32{1, 5}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := req.Labels(tc.refs)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !labels.Equal(got, tc.want) {
+				t.Fatalf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
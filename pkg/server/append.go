@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/prometheus/model/exemplar"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+)
+
+// appendResult summarizes how many exemplars of a write request were
+// accepted and why the others were rejected.
+type appendResult struct {
+	accepted int
+	// rejected counts the rejected exemplars by reason.
+	rejected map[string]int
+}
+
+func (a appendResult) numRejected() int {
+	n := 0
+	for _, c := range a.rejected {
+		n += c
+	}
+	return n
+}
+
+func (a appendResult) String() string {
+	if a.numRejected() == 0 {
+		return fmt.Sprintf("accepted %d exemplars", a.accepted)
+	}
+	reasons := make([]string, 0, len(a.rejected))
+	for reason, c := range a.rejected {
+		reasons = append(reasons, fmt.Sprintf("%d %s", c, reason))
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("accepted %d exemplars, rejected %d: %s", a.accepted, a.numRejected(), strings.Join(reasons, ", "))
+}
+
+// appendExemplars validates and appends the given series. Exemplars failing
+// validation are rejected permanently and reported in the result, the
+// remaining ones are appended. Exemplars rejected by the store are reported
+// the same way. The returned error is a storage failure of the whole batch
+// and can be retried.
+func (e *ExemplarServer) appendExemplars(ctx context.Context, series []model.SeriesExemplars) (appendResult, error) {
+	res := appendResult{rejected: map[string]int{}}
+	valid := make([]model.SeriesExemplars, 0, len(series))
+	numValid := 0
+	minValidTime := storage.MinValidTime(time.Now(), e.retention)
+	for _, s := range series {
+		exemplars := make([]exemplar.Exemplar, 0, len(s.Exemplars))
+		for _, ex := range s.Exemplars {
+			if err := storage.ValidateExemplar(s.Labels, ex, minValidTime); err != nil {
+				level.Debug(e.logger).Log("msg", "Rejected exemplar", "series", s.Labels.String(), "exemplar", fmt.Sprintf("%+v", ex), "err", err)
+				res.rejected[err.Error()]++
+				continue
+			}
+			exemplars = append(exemplars, ex)
+		}
+		if len(exemplars) == 0 {
+			continue
+		}
+		valid = append(valid, model.SeriesExemplars{Labels: s.Labels, Exemplars: exemplars})
+		numValid += len(exemplars)
+	}
+
+	if err := e.store.AppendExemplars(ctx, valid); err != nil {
+		var perr *model.PartialAppendError
+		if errors.As(err, &perr) {
+			for rerr, c := range perr.Rejected {
+				res.rejected[rerr.Error()] += c
+			}
+			res.accepted = numValid - perr.NumRejected()
+			return res, nil
+		}
+		if storage.IsPermanent(err) {
+			res.rejected[err.Error()] += numValid
+			return res, nil
+		}
+		return res, err
+	}
+	res.accepted = numValid
+	return res, nil
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+)
+
+// TestAppendRejections checks the response of remote write and OTLP for
+// every reason exemplars are rejected for. Permanent rejections are 4xx
+// for remote write and partial successes for OTLP, so they aren't retried.
+// Storage failures are 5xx.
+func TestAppendRejections(t *testing.T) {
+	now := timestamp.FromTime(time.Now())
+	traceID := []prompb.Label{{Name: "trace_id", Value: "abc"}}
+	valid := prompb.Exemplar{Labels: traceID, Value: 1, Timestamp: now}
+
+	for _, tc := range []struct {
+		name      string
+		series    []prompb.Label
+		exemplars []prompb.Exemplar
+		storeErr  error
+		wantErr   string
+		// Status codes of remote write and OTLP.
+		wantStatus     int
+		wantOTLPStatus int
+		wantWritten    string
+	}{
+		{
+			name:           "valid",
+			exemplars:      []prompb.Exemplar{valid},
+			wantStatus:     http.StatusNoContent,
+			wantOTLPStatus: http.StatusOK,
+			wantWritten:    "1",
+		},
+		{
+			name:           "invalid series labels",
+			series:         []prompb.Label{{Name: "__name__", Value: "foo"}, {Name: "job", Value: "\xff"}},
+			exemplars:      []prompb.Exemplar{valid},
+			wantErr:        storage.ErrInvalidSeriesLabels.Error(),
+			wantStatus:     http.StatusBadRequest,
+			wantOTLPStatus: http.StatusOK,
+			wantWritten:    "0",
+		},
+		{
+			name:           "invalid exemplar labels",
+			exemplars:      []prompb.Exemplar{valid, {Labels: []prompb.Label{{Name: "trace_id", Value: "\xff"}}, Timestamp: now + 1}},
+			wantErr:        storage.ErrInvalidExemplarLabels.Error(),
+			wantStatus:     http.StatusBadRequest,
+			wantOTLPStatus: http.StatusOK,
+			wantWritten:    "1",
+		},
+		{
+			name:           "exemplar labels too long",
+			exemplars:      []prompb.Exemplar{{Labels: []prompb.Label{{Name: "trace_id", Value: strings.Repeat("x", 200)}}, Timestamp: now}},
+			wantErr:        storage.ErrExemplarLabelLength.Error(),
+			wantStatus:     http.StatusBadRequest,
+			wantOTLPStatus: http.StatusOK,
+			wantWritten:    "0",
+		},
+		{
+			name:           "negative timestamp",
+			exemplars:      []prompb.Exemplar{{Labels: traceID, Timestamp: -1}},
+			wantErr:        storage.ErrOutOfBounds.Error(),
+			wantStatus:     http.StatusBadRequest,
+			wantOTLPStatus: http.StatusOK,
+			wantWritten:    "0",
+		},
+		{
+			name:           "too old",
+			exemplars:      []prompb.Exemplar{{Labels: traceID, Timestamp: now - 2*time.Hour.Milliseconds()}},
+			wantErr:        storage.ErrTooOld.Error(),
+			wantStatus:     http.StatusBadRequest,
+			wantOTLPStatus: http.StatusOK,
+			wantWritten:    "0",
+		},
+		{
+			// Rejected by the memory store, like by Prometheus.
+			name:           "out of order",
+			exemplars:      []prompb.Exemplar{valid, {Labels: traceID, Timestamp: now - 1}},
+			wantErr:        "out of order exemplar",
+			wantStatus:     http.StatusBadRequest,
+			wantOTLPStatus: http.StatusOK,
+			wantWritten:    "1",
+		},
+		{
+			name:           "storage failure",
+			exemplars:      []prompb.Exemplar{valid},
+			storeErr:       errors.New("disk full"),
+			wantErr:        "disk full",
+			wantStatus:     http.StatusInternalServerError,
+			wantOTLPStatus: http.StatusServiceUnavailable,
+			wantWritten:    "0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newServer := func() *ExemplarServer {
+				if tc.storeErr != nil {
+					return newTestServer(failingStore{err: tc.storeErr}, WithRetention(time.Hour))
+				}
+				return newTestServer(newTestStore(t), WithRetention(time.Hour))
+			}
+			series := tc.series
+			if series == nil {
+				series = []prompb.Label{{Name: "__name__", Value: "foo"}}
+			}
+
+			t.Run("remote write", func(t *testing.T) {
+				req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{Labels: series, Exemplars: tc.exemplars}}}
+				b, err := req.Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, b)))
+				w := httptest.NewRecorder()
+				newServer().Mux.ServeHTTP(w, r)
+
+				if w.Code != tc.wantStatus {
+					t.Fatalf("got status %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+				}
+				if !strings.Contains(w.Body.String(), tc.wantErr) {
+					t.Fatalf("response %q doesn't mention %q", w.Body, tc.wantErr)
+				}
+				if got := w.Header().Get(exemplarsWrittenHeader); got != tc.wantWritten {
+					t.Fatalf("got %s header %q, want %q", exemplarsWrittenHeader, got, tc.wantWritten)
+				}
+			})
+
+			t.Run("otlp", func(t *testing.T) {
+				md := pmetric.NewMetrics()
+				dp := md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty().SetEmptyGauge().DataPoints().AppendEmpty()
+				var name string
+				for _, l := range series {
+					if l.Name == "__name__" {
+						name = l.Value
+						continue
+					}
+					dp.Attributes().PutStr(l.Name, l.Value)
+				}
+				md.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).SetName(name)
+				for _, e := range tc.exemplars {
+					ex := dp.Exemplars().AppendEmpty()
+					ex.SetTimestamp(pcommon.NewTimestampFromTime(timestamp.Time(e.Timestamp)))
+					ex.SetDoubleValue(e.Value)
+					for _, l := range e.Labels {
+						ex.FilteredAttributes().PutStr(l.Name, l.Value)
+					}
+				}
+				b, err := pmetricotlp.NewExportRequestFromMetrics(md).MarshalProto()
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(b))
+				r.Header.Set("Content-Type", otlpContentTypeProtobuf)
+				w := httptest.NewRecorder()
+				newServer().Mux.ServeHTTP(w, r)
+
+				if w.Code != tc.wantOTLPStatus {
+					t.Fatalf("got status %d, want %d: %s", w.Code, tc.wantOTLPStatus, w.Body)
+				}
+				if w.Code != http.StatusOK {
+					return
+				}
+				resp := pmetricotlp.NewExportResponse()
+				if err := resp.UnmarshalProto(w.Body.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+				if msg := resp.PartialSuccess().ErrorMessage(); !strings.Contains(msg, tc.wantErr) || (tc.wantErr == "") != (msg == "") {
+					t.Fatalf("got partial success message %q, want it to mention %q", msg, tc.wantErr)
+				}
+			})
+		})
+	}
+}
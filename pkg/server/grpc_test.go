@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/thanos/pkg/exemplars/exemplarspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
+)
+
+// newGRPCClient serves the Exemplars API of srv over an in-memory
+// connection.
+func newGRPCClient(t *testing.T, srv *ExemplarServer) exemplarspb.ExemplarsClient {
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	exemplarspb.RegisterExemplarsServer(gs, srv)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return exemplarspb.NewExemplarsClient(conn)
+}
+
+// queryGRPC sends the request and receives all responses until the stream
+// ends.
+func queryGRPC(ctx context.Context, c exemplarspb.ExemplarsClient, req *exemplarspb.ExemplarsRequest) ([]*exemplarspb.ExemplarsResponse, error) {
+	stream, err := c.Exemplars(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var res []*exemplarspb.ExemplarsResponse
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		res = append(res, r)
+	}
+}
+
+func requireCode(t *testing.T, want codes.Code, err error) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Fatalf("got code %s, want %s: %v", got, want, err)
+	}
+}
+
+// blockingStore blocks selects until their context is done, and passes
+// the context to done.
+type blockingStore struct {
+	storage.ExemplarStore
+	started chan struct{}
+	done    chan context.Context
+}
+
+func (s blockingStore) SelectStream(ctx context.Context, _, _ int64, _ *model.SelectHints, _ func(exemplar.QueryResult) error, _ ...[]*labels.Matcher) (model.Warnings, error) {
+	close(s.started)
+	<-ctx.Done()
+	s.done <- ctx
+	return nil, ctx.Err()
+}
+
+func TestGRPCExemplars(t *testing.T) {
+	store := newTestStore(t)
+	var series []model.SeriesExemplars
+	for _, pod := range []string{"a", "b"} {
+		series = append(series, model.SeriesExemplars{
+			Labels:    labels.FromStrings("__name__", "foo", "pod", pod),
+			Exemplars: []exemplar.Exemplar{{Labels: labels.FromStrings("trace_id", pod), Value: 1, Ts: 1000, HasTs: true}},
+		})
+	}
+	if err := store.AppendExemplars(context.Background(), series); err != nil {
+		t.Fatal(err)
+	}
+	req := &exemplarspb.ExemplarsRequest{Query: "foo", Start: 0, End: 2000}
+
+	t.Run("series", func(t *testing.T) {
+		res, err := queryGRPC(context.Background(), newGRPCClient(t, newTestServer(store)), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 2 || res[0].GetData() == nil || res[1].GetData() == nil {
+			t.Fatalf("got %v, want a response per series", res)
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		c := newGRPCClient(t, newTestServer(store, WithQueryLimits(model.Limits{MaxSeries: 1, Truncate: true})))
+		res, err := queryGRPC(context.Background(), c, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 2 || res[0].GetData() == nil || res[1].GetWarning() == "" {
+			t.Fatalf("got %v, want a series and a warning", res)
+		}
+	})
+	t.Run("limit exceeded", func(t *testing.T) {
+		c := newGRPCClient(t, newTestServer(store, WithQueryLimits(model.Limits{MaxSeries: 1})))
+		_, err := queryGRPC(context.Background(), c, req)
+		requireCode(t, codes.ResourceExhausted, err)
+	})
+	t.Run("bad query", func(t *testing.T) {
+		_, err := queryGRPC(context.Background(), newGRPCClient(t, newTestServer(store)), &exemplarspb.ExemplarsRequest{Query: `foo{pod=~"("}`, End: 2000})
+		requireCode(t, codes.InvalidArgument, err)
+	})
+	t.Run("bad exemplar matcher", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), exemplarMatchMetadataKey, `{trace_id=`)
+		_, err := queryGRPC(ctx, newGRPCClient(t, newTestServer(store)), req)
+		requireCode(t, codes.InvalidArgument, err)
+	})
+	t.Run("bad tenant", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), tenancy.DefaultTenantHeader, "..")
+		_, err := queryGRPC(ctx, newGRPCClient(t, newTestServer(store)), req)
+		requireCode(t, codes.InvalidArgument, err)
+	})
+}
+
+// TestGRPCStreamContext checks that selects run with the context of the
+// stream, so they stop once the client cancels or its deadline is exceeded.
+func TestGRPCStreamContext(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		ctx          func() (context.Context, context.CancelFunc)
+		cancel       bool
+		wantDeadline bool
+		wantCode     codes.Code
+	}{
+		{
+			name:     "canceled",
+			ctx:      func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			cancel:   true,
+			wantCode: codes.Canceled,
+		},
+		{
+			name: "deadline exceeded",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 100*time.Millisecond)
+			},
+			wantDeadline: true,
+			wantCode:     codes.DeadlineExceeded,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := blockingStore{started: make(chan struct{}), done: make(chan context.Context, 1)}
+			c := newGRPCClient(t, newTestServer(store))
+			ctx, cancel := tc.ctx()
+			defer cancel()
+			if tc.cancel {
+				go func() {
+					<-store.started
+					cancel()
+				}()
+			}
+
+			_, err := queryGRPC(ctx, c, &exemplarspb.ExemplarsRequest{Query: "foo", End: 2000})
+			requireCode(t, tc.wantCode, err)
+			select {
+			case ctx := <-store.done:
+				// The server may see the client cancel the stream before its
+				// own deadline is exceeded.
+				if _, ok := ctx.Deadline(); ok != tc.wantDeadline {
+					t.Fatalf("select had a deadline %t, want %t", ok, tc.wantDeadline)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("select wasn't stopped")
+			}
+		})
+	}
+}
+
+// TestGRPCErrors checks that the errors of the store are mapped to gRPC
+// status codes.
+func TestGRPCErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{name: "canceled", err: &model.ExecutionError{Err: context.Canceled}, want: codes.Canceled},
+		{name: "deadline exceeded", err: errors.Wrap(context.DeadlineExceeded, "select"), want: codes.DeadlineExceeded},
+		{name: "limit", err: &model.LimitError{Limit: "series", Max: 1}, want: codes.ResourceExhausted},
+		{name: "status", err: status.Error(codes.Unavailable, "unavailable"), want: codes.Unavailable},
+		{name: "internal", err: errors.New("disk full"), want: codes.Internal},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newGRPCClient(t, newTestServer(failingStore{err: tc.err}))
+			_, err := queryGRPC(context.Background(), c, &exemplarspb.ExemplarsRequest{Query: "foo", End: 2000})
+			requireCode(t, tc.want, err)
+		})
+	}
+}
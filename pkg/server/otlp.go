@@ -0,0 +1,348 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-kit/log/level"
+	"github.com/klauspost/compress/gzip"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+)
+
+const (
+	otlpContentTypeProtobuf = "application/x-protobuf"
+	otlpContentTypeJSON     = "application/json"
+
+	// Labels exemplars carry their trace context in, matching Prometheus.
+	traceIDLabel = "trace_id"
+	spanIDLabel  = "span_id"
+
+	// maxOTLPBodySize bounds the size of OTLP request bodies, both as sent
+	// and decompressed. Same default as the max_request_body_size of the
+	// OpenTelemetry Collector.
+	maxOTLPBodySize = 20 << 20
+)
+
+var errOTLPBodyTooLarge = fmt.Errorf("request body too large, the limit is %d bytes", maxOTLPBodySize)
+
+// OTLPMetrics is an OTLP/HTTP metrics receiver. Only the exemplars of the
+// received data points are stored, the data points themselves are dropped.
+func (e *ExemplarServer) OTLPMetrics(w http.ResponseWriter, r *http.Request) {
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (contentType != otlpContentTypeProtobuf && contentType != otlpContentTypeJSON) {
+		http.Error(w, "unsupported content type, supported: [application/x-protobuf, application/json]", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := readOTLPBody(w, r)
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Error reading OTLP request", "err", err.Error())
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, errOTLPBodyTooLarge) || errors.As(err, &maxBytesErr) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := pmetricotlp.NewExportRequest()
+	if contentType == otlpContentTypeJSON {
+		err = req.UnmarshalJSON(body)
+	} else {
+		err = req.UnmarshalProto(body)
+	}
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Error decoding OTLP request", "err", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series := otlpMetricsToSeriesExemplars(req.Metrics())
+	res, err := e.appendExemplars(r.Context(), series)
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Error while adding OTLP exemplars in AppendExemplars", "series", len(series), "err", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := pmetricotlp.NewExportResponse()
+	if res.numRejected() > 0 {
+		level.Warn(e.logger).Log("msg", "Rejected exemplars in OTLP request", "summary", res.String())
+		resp.PartialSuccess().SetErrorMessage(res.String())
+	}
+	var out []byte
+	if contentType == otlpContentTypeJSON {
+		out, err = resp.MarshalJSON()
+	} else {
+		out, err = resp.MarshalProto()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// readOTLPBody reads the decompressed request body. Bodies larger than
+// maxOTLPBodySize fail with errOTLPBodyTooLarge, or a *http.MaxBytesError if
+// they are too large before decompression.
+func readOTLPBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := io.Reader(http.MaxBytesReader(w, r.Body, maxOTLPBodySize))
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		body = gr
+	}
+
+	// Read one byte more than allowed to tell whether the body was cut.
+	b, err := io.ReadAll(io.LimitReader(body, maxOTLPBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxOTLPBodySize {
+		return nil, errOTLPBodyTooLarge
+	}
+	return b, nil
+}
+
+// otlpMetricsToSeriesExemplars converts the exemplars of the given metrics.
+// Series labels are built like Prometheus' OTLP translation does: data point
+// attributes, job and instance derived from the resource and the
+// instrumentation scope name and version.
+func otlpMetricsToSeriesExemplars(md pmetric.Metrics) []model.SeriesExemplars {
+	var series []model.SeriesExemplars
+	rms := md.ResourceMetrics()
+	for i := 0; i < rms.Len(); i++ {
+		rm := rms.At(i)
+		resourceLabels := otlpResourceLabels(rm.Resource())
+		sms := rm.ScopeMetrics()
+		for j := 0; j < sms.Len(); j++ {
+			sm := sms.At(j)
+			scopeLabels := otlpScopeLabels(sm.Scope())
+			ms := sm.Metrics()
+			for k := 0; k < ms.Len(); k++ {
+				m := ms.At(k)
+				name := sanitizeMetricName(m.Name())
+				switch m.Type() {
+				case pmetric.MetricTypeGauge:
+					series = appendNumberDataPoints(series, name, m.Gauge().DataPoints(), resourceLabels, scopeLabels)
+				case pmetric.MetricTypeSum:
+					series = appendNumberDataPoints(series, name, m.Sum().DataPoints(), resourceLabels, scopeLabels)
+				case pmetric.MetricTypeHistogram:
+					series = appendHistogramDataPoints(series, name, m.Histogram().DataPoints(), resourceLabels, scopeLabels)
+				case pmetric.MetricTypeExponentialHistogram:
+					dps := m.ExponentialHistogram().DataPoints()
+					for l := 0; l < dps.Len(); l++ {
+						dp := dps.At(l)
+						series = appendSeriesExemplars(series, otlpSeriesLabels(name, dp.Attributes(), resourceLabels, scopeLabels), dp.Exemplars())
+					}
+				}
+			}
+		}
+	}
+	return series
+}
+
+func appendNumberDataPoints(series []model.SeriesExemplars, name string, dps pmetric.NumberDataPointSlice, resourceLabels, scopeLabels []labels.Label) []model.SeriesExemplars {
+	for i := 0; i < dps.Len(); i++ {
+		dp := dps.At(i)
+		series = appendSeriesExemplars(series, otlpSeriesLabels(name, dp.Attributes(), resourceLabels, scopeLabels), dp.Exemplars())
+	}
+	return series
+}
+
+// appendHistogramDataPoints attaches every exemplar to the _bucket series of
+// the bucket its value falls into.
+func appendHistogramDataPoints(series []model.SeriesExemplars, name string, dps pmetric.HistogramDataPointSlice, resourceLabels, scopeLabels []labels.Label) []model.SeriesExemplars {
+	for i := 0; i < dps.Len(); i++ {
+		dp := dps.At(i)
+		if dp.Exemplars().Len() == 0 {
+			continue
+		}
+		lset := otlpSeriesLabels(name+"_bucket", dp.Attributes(), resourceLabels, scopeLabels)
+		bounds := dp.ExplicitBounds()
+		buckets := map[string][]exemplar.Exemplar{}
+		var les []string
+		for j := 0; j < dp.Exemplars().Len(); j++ {
+			e := otlpExemplarToExemplar(dp.Exemplars().At(j))
+			le := "+Inf"
+			for k := 0; k < bounds.Len(); k++ {
+				if e.Value <= bounds.At(k) {
+					le = strconv.FormatFloat(bounds.At(k), 'f', -1, 64)
+					break
+				}
+			}
+			if _, ok := buckets[le]; !ok {
+				les = append(les, le)
+			}
+			buckets[le] = append(buckets[le], e)
+		}
+		for _, le := range les {
+			series = append(series, model.SeriesExemplars{
+				Labels:    labels.NewBuilder(lset).Set(labels.BucketLabel, le).Labels(nil),
+				Exemplars: buckets[le],
+			})
+		}
+	}
+	return series
+}
+
+func appendSeriesExemplars(series []model.SeriesExemplars, lset labels.Labels, es pmetric.ExemplarSlice) []model.SeriesExemplars {
+	if es.Len() == 0 {
+		return series
+	}
+	exemplars := make([]exemplar.Exemplar, 0, es.Len())
+	for i := 0; i < es.Len(); i++ {
+		exemplars = append(exemplars, otlpExemplarToExemplar(es.At(i)))
+	}
+	return append(series, model.SeriesExemplars{
+		Labels:    lset,
+		Exemplars: exemplars,
+	})
+}
+
+func otlpExemplarToExemplar(e pmetric.Exemplar) exemplar.Exemplar {
+	var extra []labels.Label
+	if traceID := e.TraceID(); !traceID.IsEmpty() {
+		extra = append(extra, labels.Label{Name: traceIDLabel, Value: traceID.String()})
+	}
+	if spanID := e.SpanID(); !spanID.IsEmpty() {
+		extra = append(extra, labels.Label{Name: spanIDLabel, Value: spanID.String()})
+	}
+
+	var v float64
+	switch e.ValueType() {
+	case pmetric.ExemplarValueTypeDouble:
+		v = e.DoubleValue()
+	case pmetric.ExemplarValueTypeInt:
+		v = float64(e.IntValue())
+	}
+
+	ts := timestamp.FromTime(e.Timestamp().AsTime())
+	return exemplar.Exemplar{
+		Labels: attributesToLabels(e.FilteredAttributes(), extra...),
+		Value:  v,
+		Ts:     ts,
+		HasTs:  ts != 0,
+	}
+}
+
+func otlpResourceLabels(r pcommon.Resource) []labels.Label {
+	var lbls []labels.Label
+	attrs := r.Attributes()
+	if serviceName, ok := attrs.Get("service.name"); ok {
+		job := serviceName.AsString()
+		if serviceNamespace, ok := attrs.Get("service.namespace"); ok {
+			job = serviceNamespace.AsString() + "/" + job
+		}
+		lbls = append(lbls, labels.Label{Name: "job", Value: job})
+	}
+	if instance, ok := attrs.Get("service.instance.id"); ok {
+		lbls = append(lbls, labels.Label{Name: "instance", Value: instance.AsString()})
+	}
+	return lbls
+}
+
+func otlpScopeLabels(s pcommon.InstrumentationScope) []labels.Label {
+	var lbls []labels.Label
+	if s.Name() != "" {
+		lbls = append(lbls, labels.Label{Name: "otel_scope_name", Value: s.Name()})
+	}
+	if s.Version() != "" {
+		lbls = append(lbls, labels.Label{Name: "otel_scope_version", Value: s.Version()})
+	}
+	return lbls
+}
+
+func otlpSeriesLabels(name string, attrs pcommon.Map, resourceLabels, scopeLabels []labels.Label) labels.Labels {
+	extra := make([]labels.Label, 0, len(resourceLabels)+len(scopeLabels)+1)
+	extra = append(extra, resourceLabels...)
+	extra = append(extra, scopeLabels...)
+	extra = append(extra, labels.Label{Name: labels.MetricName, Value: name})
+	return attributesToLabels(attrs, extra...)
+}
+
+// attributesToLabels converts attributes to labels with sanitized names.
+// Attributes colliding after sanitization are joined with ";" in the order of
+// their original keys. Extra labels override attributes of the same name.
+func attributesToLabels(attrs pcommon.Map, extra ...labels.Label) labels.Labels {
+	keys := make([]string, 0, attrs.Len())
+	attrs.Range(func(k string, _ pcommon.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	sort.Strings(keys)
+
+	values := make(map[string]string, len(keys)+len(extra))
+	for _, k := range keys {
+		v, _ := attrs.Get(k)
+		name := sanitizeLabelName(k)
+		if existing, ok := values[name]; ok {
+			values[name] = existing + ";" + v.AsString()
+		} else {
+			values[name] = v.AsString()
+		}
+	}
+	for _, l := range extra {
+		values[l.Name] = l.Value
+	}
+
+	b := labels.ScratchBuilder{}
+	for name, value := range values {
+		if name == "" || value == "" {
+			continue
+		}
+		b.Add(name, value)
+	}
+	b.Sort()
+	return b.Labels()
+}
+
+// sanitizeLabelName follows Prometheus' OTLP label normalization.
+func sanitizeLabelName(name string) string {
+	if name == "" {
+		return name
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+	if unicode.IsDigit(rune(name[0])) {
+		return "key_" + name
+	}
+	if strings.HasPrefix(name, "_") && !strings.HasPrefix(name, "__") {
+		return "key" + name
+	}
+	return name
+}
+
+func sanitizeMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+)
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "api")
+	m := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	m.SetName("http.requests")
+	dp := m.SetEmptySum().DataPoints().AppendEmpty()
+	dp.Attributes().PutStr("method", "GET")
+	ex := dp.Exemplars().AppendEmpty()
+	ex.SetTimestamp(pcommon.NewTimestampFromTime(time.UnixMilli(1000)))
+	ex.SetDoubleValue(2)
+	ex.SetTraceID(pcommon.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+
+	proto, err := pmetricotlp.NewExportRequestFromMetrics(md).MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []exemplar.QueryResult{{
+		SeriesLabels: labels.FromStrings("__name__", "http_requests", "job", "api", "method", "GET"),
+		Exemplars: []exemplar.Exemplar{{
+			Labels: labels.FromStrings(traceIDLabel, "0102030405060708090a0b0c0d0e0f10"),
+			Value:  2,
+			Ts:     1000,
+			HasTs:  true,
+		}},
+	}}
+
+	for _, tc := range []struct {
+		name            string
+		contentType     string
+		contentEncoding string
+		body            []byte
+		wantStatus      int
+	}{
+		{name: "protobuf", contentType: otlpContentTypeProtobuf, body: proto, wantStatus: http.StatusOK},
+		{name: "gzip", contentType: otlpContentTypeProtobuf, contentEncoding: "gzip", body: gzipped(t, proto), wantStatus: http.StatusOK},
+		{name: "unsupported content type", contentType: "text/plain", body: proto, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "invalid gzip", contentType: otlpContentTypeProtobuf, contentEncoding: "gzip", body: proto, wantStatus: http.StatusBadRequest},
+		{name: "too large", contentType: otlpContentTypeProtobuf, body: make([]byte, maxOTLPBodySize+1), wantStatus: http.StatusRequestEntityTooLarge},
+		// Compresses to a few KB but decompresses beyond the limit.
+		{name: "gzip bomb", contentType: otlpContentTypeProtobuf, contentEncoding: "gzip", body: gzipped(t, make([]byte, maxOTLPBodySize+1)), wantStatus: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newTestStore(t)
+			srv := newTestServer(store)
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			if tc.contentEncoding != "" {
+				r.Header.Set("Content-Encoding", tc.contentEncoding)
+			}
+			w := httptest.NewRecorder()
+			srv.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantStatus == http.StatusOK {
+				assertResults(t, selectAll(t, store), want)
+			}
+		})
+	}
+}
+
+func TestOTLPHistogramBuckets(t *testing.T) {
+	md := pmetric.NewMetrics()
+	m := md.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	m.SetName("latency")
+	dp := m.SetEmptyHistogram().DataPoints().AppendEmpty()
+	dp.ExplicitBounds().FromRaw([]float64{0.1, 1, 2.5})
+	for i, v := range []float64{0.05, 0.1, 0.5, 3, 0.2} {
+		ex := dp.Exemplars().AppendEmpty()
+		ex.SetTimestamp(pcommon.NewTimestampFromTime(time.UnixMilli(int64(i + 1))))
+		ex.SetDoubleValue(v)
+	}
+	// Histograms without exemplars don't produce series.
+	m.Histogram().DataPoints().AppendEmpty().ExplicitBounds().FromRaw([]float64{1})
+
+	got := otlpMetricsToSeriesExemplars(md)
+	// Bounds are inclusive upper bounds, like le.
+	want := []struct {
+		le string
+		ts []int64
+	}{
+		{le: "0.1", ts: []int64{1, 2}},
+		{le: "1", ts: []int64{3, 5}},
+		{le: "+Inf", ts: []int64{4}},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d series, want %d: %v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		lset := labels.FromStrings("__name__", "latency_bucket", "le", w.le)
+		if !labels.Equal(got[i].Labels, lset) {
+			t.Fatalf("got series %s, want %s", got[i].Labels, lset)
+		}
+		var ts []int64
+		for _, e := range got[i].Exemplars {
+			ts = append(ts, e.Ts)
+		}
+		if len(ts) != len(w.ts) {
+			t.Fatalf("got exemplars at %v for %s, want %v", ts, lset, w.ts)
+		}
+		for j := range ts {
+			if ts[j] != w.ts[j] {
+				t.Fatalf("got exemplars at %v for %s, want %v", ts, lset, w.ts)
+			}
+		}
+	}
+}
+
+func TestAttributesToLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		attrs map[string]interface{}
+		extra []labels.Label
+		want  labels.Labels
+	}{
+		{
+			name:  "sanitized names",
+			attrs: map[string]interface{}{"http.method": "GET", "1st": "a", "_private": "b", "__reserved": "c"},
+			want:  labels.FromStrings("http_method", "GET", "key_1st", "a", "key_private", "b", "__reserved", "c"),
+		},
+		{
+			// Keys sort as a-b, a.b, a_b, values are joined in that order.
+			name:  "collisions joined in key order",
+			attrs: map[string]interface{}{"a_b": "2", "a.b": "1", "a-b": "0"},
+			want:  labels.FromStrings("a_b", "0;1;2"),
+		},
+		{
+			name:  "non-string values",
+			attrs: map[string]interface{}{"code": int64(200), "ok": true},
+			want:  labels.FromStrings("code", "200", "ok", "true"),
+		},
+		{
+			name:  "extra labels override attributes",
+			attrs: map[string]interface{}{"job": "attr", "__name__": "attr", "path": "/"},
+			extra: []labels.Label{{Name: "job", Value: "resource"}, {Name: "__name__", Value: "metric"}},
+			want:  labels.FromStrings("__name__", "metric", "job", "resource", "path", "/"),
+		},
+		{
+			name:  "empty values dropped",
+			attrs: map[string]interface{}{"empty": "", "": "no name"},
+			extra: []labels.Label{{Name: "instance", Value: ""}},
+			want:  labels.EmptyLabels(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attrs := pcommon.NewMap()
+			if err := attrs.FromRaw(tc.attrs); err != nil {
+				t.Fatal(err)
+			}
+			if got := attributesToLabels(attrs, tc.extra...); !labels.Equal(got, tc.want) {
+				t.Fatalf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -6,12 +6,32 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
 	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/timestamp"
 	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
 )
 
+// exemplarMatchParam is the query parameter holding selectors on exemplar
+// labels.
+const exemplarMatchParam = "exemplar_match[]"
+
+// swappedComparisons maps comparison operators to the operator with
+// swapped operands.
+var swappedComparisons = map[parser.ItemType]parser.ItemType{
+	parser.GTR:  parser.LSS,
+	parser.GTE:  parser.LTE,
+	parser.LSS:  parser.GTR,
+	parser.LTE:  parser.GTE,
+	parser.EQLC: parser.EQLC,
+	parser.NEQ:  parser.NEQ,
+}
+
 var (
 	minTime = time.Unix(math.MinInt64/1000+62135596801, 0).UTC()
 	maxTime = time.Unix(math.MaxInt64/1000-62135596801, 999999999).UTC()
@@ -20,36 +40,113 @@ var (
 	maxTimeFormatted = maxTime.Format(time.RFC3339Nano)
 )
 
+// QueryExemplars returns the exemplars of the series selected by the query,
+// series sorted by labels and exemplars by timestamp, in descending order
+// with order=desc. With a step, it returns at most max_per_step exemplars
+// (1 by default) per series and step, preferring the highest values.
+// Queries exceeding the limits of the server fail, or are truncated with a
+// warning.
 func (e *ExemplarServer) QueryExemplars(w http.ResponseWriter, r *http.Request) {
-	start, err := parseTimeParam(r, "start", minTime)
+	req, err := parseSelectRequest(r)
 	if err != nil {
-		render.Render(w, r, ErrBadData(errors.Wrapf(err, "invalid parameter start")))
+		render.Render(w, r, ErrBadData(err))
 		return
 	}
-	end, err := parseTimeParam(r, "end", maxTime)
-	if err != nil {
-		render.Render(w, r, ErrBadData(errors.Wrapf(err, "invalid parameter end")))
+	if err := parseThinning(r, req.hints); err != nil {
+		render.Render(w, r, ErrBadData(err))
 		return
 	}
-	if end.Before(start) {
-		err := errors.New("end timestamp must not be before start timestamp")
+	if err := parseOrder(r, req.hints); err != nil {
 		render.Render(w, r, ErrBadData(err))
 		return
 	}
+	req.hints.Limits = e.limits
+	if len(req.selectors) < 1 {
+		render.Render(w, r, SuccessResponse(nil))
+		return
+	}
 
-	expr, err := parser.ParseExpr(r.FormValue("query"))
+	res, warnings, err := e.store.Select(r.Context(), req.start, req.end, req.hints, req.selectors...)
+	if err != nil {
+		render.Render(w, r, returnAPIErrorWrapper(err))
+		return
+	}
+
+	render.Render(w, r, SuccessResponse(res, warnings...))
+}
+
+// QueryTopKExemplars returns the k exemplars with the highest values of the
+// series selected by the query, or the k highest of every series with
+// per_series=true. Queries keeping more exemplars than the limits of the
+// server allow fail.
+func (e *ExemplarServer) QueryTopKExemplars(w http.ResponseWriter, r *http.Request) {
+	req, err := parseSelectRequest(r)
 	if err != nil {
 		render.Render(w, r, ErrBadData(err))
 		return
 	}
+	k, err := strconv.Atoi(r.FormValue("k"))
+	if err != nil || k <= 0 {
+		render.Render(w, r, ErrBadData(errors.New("invalid parameter k: must be a positive integer")))
+		return
+	}
+	perSeries := false
+	if v := r.FormValue("per_series"); v != "" {
+		if perSeries, err = strconv.ParseBool(v); err != nil {
+			render.Render(w, r, ErrBadData(errors.Wrap(err, "invalid parameter per_series")))
+			return
+		}
+	}
+	req.hints.Limits = e.limits
+	if len(req.selectors) < 1 {
+		render.Render(w, r, SuccessResponse(nil))
+		return
+	}
+
+	res, err := e.store.SelectTopK(r.Context(), req.start, req.end, k, perSeries, req.hints, req.selectors...)
+	if err != nil {
+		render.Render(w, r, returnAPIErrorWrapper(err))
+		return
+	}
+
+	render.Render(w, r, SuccessResponse(res))
+}
 
-	selectors := parser.ExtractSelectors(expr)
-	if len(selectors) < 1 {
+// QueryExemplarDensity returns the number of exemplars of the series
+// selected by the query per step, and the quantiles of their values given
+// with the quantile parameter. Queries keeping more buckets and values for
+// quantiles than the limits of the server allow fail.
+func (e *ExemplarServer) QueryExemplarDensity(w http.ResponseWriter, r *http.Request) {
+	req, err := parseSelectRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrBadData(err))
+		return
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil {
+		render.Render(w, r, ErrBadData(errors.Wrap(err, "invalid parameter step")))
+		return
+	}
+	if step < time.Millisecond {
+		render.Render(w, r, ErrBadData(errors.New("invalid parameter step: must be at least 1ms")))
+		return
+	}
+	quantiles := make([]float64, 0, len(r.Form["quantile"]))
+	for _, v := range r.Form["quantile"] {
+		q, err := strconv.ParseFloat(v, 64)
+		if err != nil || q < 0 || q > 1 {
+			render.Render(w, r, ErrBadData(errors.Errorf("invalid parameter quantile: %q must be between 0 and 1", v)))
+			return
+		}
+		quantiles = append(quantiles, q)
+	}
+	req.hints.Limits = e.limits
+	if len(req.selectors) < 1 {
 		render.Render(w, r, SuccessResponse(nil))
 		return
 	}
 
-	res, err := e.store.Select(r.Context(), timestamp.FromTime(start), timestamp.FromTime(end), selectors...)
+	res, err := e.store.SelectDensity(r.Context(), req.start, req.end, step.Milliseconds(), quantiles, req.hints, req.selectors...)
 	if err != nil {
 		render.Render(w, r, returnAPIErrorWrapper(err))
 		return
@@ -58,6 +155,214 @@ func (e *ExemplarServer) QueryExemplars(w http.ResponseWriter, r *http.Request)
 	render.Render(w, r, SuccessResponse(res))
 }
 
+// parseOrder sets the order of the exemplars of every series from the order
+// parameter, asc (default) or desc.
+func parseOrder(r *http.Request, hints *model.SelectHints) error {
+	switch v := r.FormValue("order"); v {
+	case "", "asc":
+	case "desc":
+		hints.Descending = true
+	default:
+		return errors.Errorf("invalid parameter order: %q must be asc or desc", v)
+	}
+	return nil
+}
+
+// parseThinning sets the step and the maximum number of exemplars per step
+// of hints from the optional step and max_per_step parameters.
+func parseThinning(r *http.Request, hints *model.SelectHints) error {
+	if v := r.FormValue("step"); v != "" {
+		step, err := parseDuration(v)
+		if err != nil {
+			return errors.Wrap(err, "invalid parameter step")
+		}
+		if step < time.Millisecond {
+			return errors.New("invalid parameter step: must be at least 1ms")
+		}
+		hints.Step = step.Milliseconds()
+		hints.MaxPerStep = 1
+	}
+	if v := r.FormValue("max_per_step"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return errors.New("invalid parameter max_per_step: must be a positive integer")
+		}
+		if hints.Step == 0 {
+			return errors.New("invalid parameter max_per_step: requires a step")
+		}
+		hints.MaxPerStep = n
+	}
+	return nil
+}
+
+// selectRequest holds the parameters of the endpoints selecting exemplars
+// by a query.
+type selectRequest struct {
+	start, end int64
+	selectors  [][]*labels.Matcher
+	hints      *model.SelectHints
+}
+
+// parseSelectRequest parses the query, its time range, and the exemplar
+// matchers and value range narrowing the selected exemplars.
+func parseSelectRequest(r *http.Request) (selectRequest, error) {
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		return selectRequest{}, err
+	}
+
+	expr, err := parser.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		return selectRequest{}, err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return selectRequest{}, errors.Wrapf(err, "error parsing form values")
+	}
+	exemplarMatchers, err := parseExemplarMatchers(r.Form[exemplarMatchParam])
+	if err != nil {
+		return selectRequest{}, errors.Wrapf(err, "invalid parameter %s", exemplarMatchParam)
+	}
+	hints := &model.SelectHints{ExemplarMatchers: exemplarMatchers}
+	valueRangeFromExpr(expr, hints)
+	for _, p := range []struct {
+		name  string
+		limit func(*model.SelectHints, float64)
+	}{
+		{name: "min_value", limit: limitMinValue},
+		{name: "max_value", limit: limitMaxValue},
+	} {
+		if v := r.FormValue(p.name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return selectRequest{}, errors.Wrapf(err, "invalid parameter %s", p.name)
+			}
+			p.limit(hints, f)
+		}
+	}
+
+	return selectRequest{
+		start:     timestamp.FromTime(start),
+		end:       timestamp.FromTime(end),
+		selectors: parser.ExtractSelectors(expr),
+		hints:     hints,
+	}, nil
+}
+
+// parseExemplarMatchers parses selectors on exemplar labels.
+func parseExemplarMatchers(selectors []string) ([][]*labels.Matcher, error) {
+	res := make([][]*labels.Matcher, 0, len(selectors))
+	for _, s := range selectors {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, matchers)
+	}
+	return res, nil
+}
+
+// valueRangeFromExpr limits the exemplar values of hints if expr compares a
+// vector selector with a number, like `http_request_duration_seconds_bucket > 2`.
+// Other expressions are ignored.
+func valueRangeFromExpr(expr parser.Expr, hints *model.SelectHints) {
+	b, ok := unwrapParens(expr).(*parser.BinaryExpr)
+	if !ok || !b.Op.IsComparisonOperator() || b.ReturnBool {
+		return
+	}
+
+	lhs, rhs := unwrapParens(b.LHS), unwrapParens(b.RHS)
+	op := b.Op
+	if _, ok := lhs.(*parser.NumberLiteral); ok {
+		// Turn `2 < foo` into `foo > 2`.
+		lhs, rhs = rhs, lhs
+		op = swappedComparisons[op]
+	}
+	n, ok := rhs.(*parser.NumberLiteral)
+	if _, vs := lhs.(*parser.VectorSelector); !ok || !vs {
+		return
+	}
+
+	switch op {
+	case parser.GTR:
+		limitMinValue(hints, math.Nextafter(n.Val, math.Inf(1)))
+	case parser.GTE:
+		limitMinValue(hints, n.Val)
+	case parser.LSS:
+		limitMaxValue(hints, math.Nextafter(n.Val, math.Inf(-1)))
+	case parser.LTE:
+		limitMaxValue(hints, n.Val)
+	case parser.EQLC:
+		limitMinValue(hints, n.Val)
+		limitMaxValue(hints, n.Val)
+	}
+}
+
+func unwrapParens(expr parser.Expr) parser.Expr {
+	for {
+		p, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.Expr
+	}
+}
+
+// limitMinValue raises the minimum value of hints to v.
+func limitMinValue(hints *model.SelectHints, v float64) {
+	if hints.MinValue == nil || v > *hints.MinValue {
+		hints.MinValue = &v
+	}
+}
+
+// limitMaxValue lowers the maximum value of hints to v.
+func limitMaxValue(hints *model.SelectHints, v float64) {
+	if hints.MaxValue == nil || v < *hints.MaxValue {
+		hints.MaxValue = &v
+	}
+}
+
+// QueryTraceExemplars returns all exemplars referencing the trace in the URL
+// path, grouped by series. Traces with more exemplars than the limits of the
+// server allow fail.
+func (e *ExemplarServer) QueryTraceExemplars(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		render.Render(w, r, ErrBadData(err))
+		return
+	}
+	traceID := chi.URLParam(r, "trace_id")
+	if traceID == "" {
+		render.Render(w, r, ErrBadData(errors.New("missing trace ID")))
+		return
+	}
+
+	res, err := e.store.SelectByTraceID(r.Context(), timestamp.FromTime(start), timestamp.FromTime(end), e.traceLabel, traceID, e.limits)
+	if err != nil {
+		render.Render(w, r, returnAPIErrorWrapper(err))
+		return
+	}
+
+	render.Render(w, r, SuccessResponse(res))
+}
+
+// parseTimeRange parses the optional start and end parameters, defaulting to
+// the whole time range.
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	start, err := parseTimeParam(r, "start", minTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "invalid parameter start")
+	}
+	end, err := parseTimeParam(r, "end", maxTime)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "invalid parameter end")
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, errors.New("end timestamp must not be before start timestamp")
+	}
+	return start, end, nil
+}
+
 func parseTimeParam(r *http.Request, paramName string, defaultValue time.Time) (time.Time, error) {
 	val := r.FormValue(paramName)
 	if val == "" {
@@ -92,3 +397,17 @@ func parseTime(s string) (time.Time, error) {
 	}
 	return time.Time{}, errors.Errorf("cannot parse %q to a valid timestamp", s)
 }
+
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, errors.Errorf("cannot parse %q to a valid duration. It overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+	if d, err := prommodel.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, errors.Errorf("cannot parse %q to a valid duration", s)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+)
+
+// query serves a GET request for url and returns the decoded response.
+func query(t *testing.T, srv *ExemplarServer, url string) (int, response) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	srv.Mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	var res response
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body, err)
+	}
+	return w.Code, res
+}
+
+// TestQueryLimits checks that the topk, density and trace APIs fail with an
+// execution error once they exceed the limits of the server.
+func TestQueryLimits(t *testing.T) {
+	store := newTestStore(t)
+	var series []model.SeriesExemplars
+	for _, pod := range []string{"a", "b", "c"} {
+		series = append(series, model.SeriesExemplars{
+			Labels: labels.FromStrings("__name__", "foo", "pod", pod),
+			Exemplars: []exemplar.Exemplar{
+				{Labels: labels.FromStrings("trace_id", "abc"), Value: 1, Ts: 1000, HasTs: true},
+				{Labels: labels.FromStrings("trace_id", "def"), Value: 2, Ts: 2000, HasTs: true},
+			},
+		})
+	}
+	if err := store.AppendExemplars(context.Background(), series); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		limits model.Limits
+	}{
+		{name: "topk", url: "/api/v1/exemplars/topk?query=foo&k=3", limits: model.Limits{MaxExemplars: 2}},
+		{name: "topk per series", url: "/api/v1/exemplars/topk?query=foo&k=1&per_series=true", limits: model.Limits{MaxSeries: 2}},
+		{name: "density", url: "/api/v1/exemplars/density?query=foo&step=1s", limits: model.Limits{MaxExemplars: 5}},
+		{name: "density quantiles", url: "/api/v1/exemplars/density?query=foo&step=1h&quantile=0.5", limits: model.Limits{MaxExemplars: 5}},
+		{name: "trace", url: "/api/v1/exemplars/trace/abc", limits: model.Limits{MaxSeries: 2, Truncate: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, res := query(t, newTestServer(store), tc.url)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d without limits: %s", code, res.Error)
+			}
+			code, res = query(t, newTestServer(store, WithQueryLimits(tc.limits)), tc.url)
+			if code != http.StatusUnprocessableEntity || res.ErrorType != "execution" {
+				t.Fatalf("got status %d and error type %q, want an execution error: %s", code, res.ErrorType, res.Error)
+			}
+		})
+	}
+}
+
+// TestQueryErrors checks that every query API maps the errors of the store
+// to the error types of the Prometheus API.
+func TestQueryErrors(t *testing.T) {
+	urls := map[string]string{
+		"query":   "/api/v1/query_exemplars?query=foo",
+		"topk":    "/api/v1/exemplars/topk?query=foo&k=1",
+		"density": "/api/v1/exemplars/density?query=foo&step=1m",
+		"trace":   "/api/v1/exemplars/trace/abc",
+	}
+	for _, tc := range []struct {
+		name          string
+		err           error
+		wantStatus    int
+		wantErrorType string
+	}{
+		{name: "canceled", err: context.Canceled, wantStatus: 499, wantErrorType: "canceled"},
+		{name: "canceled execution", err: &model.ExecutionError{Err: context.Canceled}, wantStatus: 499, wantErrorType: "canceled"},
+		{name: "deadline exceeded", err: errors.Wrap(context.DeadlineExceeded, "select"), wantStatus: http.StatusServiceUnavailable, wantErrorType: "timeout"},
+		{name: "limit", err: &model.LimitError{Limit: "series", Max: 1}, wantStatus: http.StatusUnprocessableEntity, wantErrorType: "execution"},
+		{name: "execution", err: &model.ExecutionError{Err: errors.New("column not found")}, wantStatus: http.StatusUnprocessableEntity, wantErrorType: "execution"},
+		{name: "internal", err: errors.New("disk full"), wantStatus: http.StatusInternalServerError, wantErrorType: "internal"},
+	} {
+		srv := newTestServer(failingStore{err: tc.err})
+		for api, url := range urls {
+			t.Run(fmt.Sprintf("%s %s", api, tc.name), func(t *testing.T) {
+				code, res := query(t, srv, url)
+				if code != tc.wantStatus || res.Status != "error" || res.ErrorType != tc.wantErrorType {
+					t.Fatalf("got status %d and error type %q, want %d and %q", code, res.ErrorType, tc.wantStatus, tc.wantErrorType)
+				}
+				if res.Error != tc.err.Error() {
+					t.Fatalf("got error %q, want %q", res.Error, tc.err)
+				}
+			})
+		}
+	}
+}
@@ -3,7 +3,10 @@ package server
 import (
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/go-kit/log/level"
 	"github.com/gogo/protobuf/proto"
@@ -11,51 +14,199 @@ import (
 	"github.com/prometheus/prometheus/model/exemplar"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/yeya24/exemplars-storage/pkg/prompb/writev2"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+)
+
+const (
+	remoteWriteVersionHeader = "X-Prometheus-Remote-Write-Version"
+	exemplarsWrittenHeader   = "X-Prometheus-Remote-Write-Exemplars-Written"
+	samplesWrittenHeader     = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader  = "X-Prometheus-Remote-Write-Histograms-Written"
+
+	protoMsgV1 = "prometheus.WriteRequest"
+	protoMsgV2 = "io.prometheus.write.v2.Request"
 )
 
 func (e *ExemplarServer) RemoteWrite(w http.ResponseWriter, r *http.Request) {
-	req, err := DecodeWriteRequest(r.Body)
+	protoMsg, err := parseProtoMsg(r.Header.Get("Content-Type"), r.Header.Get(remoteWriteVersionHeader))
 	if err != nil {
-		level.Error(e.logger).Log("msg", "Error decoding remote write request", "err", err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		level.Error(e.logger).Log("msg", "Error parsing remote write content type", "err", err.Error())
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
 		return
 	}
 
-	var exemplarErr error
-	for _, ts := range req.Timeseries {
-		lbls := labelProtosToLabels(ts.Labels)
-		for _, ep := range ts.Exemplars {
-			exemplar := exemplarProtoToExemplar(ep)
-			if err := e.store.AppendExemplar(r.Context(), lbls, exemplar); err != nil {
-				level.Error(e.logger).Log("msg", "Error while adding exemplar in AddExemplar", "exemplar", fmt.Sprintf("%+v", exemplar), "err", exemplarErr)
-			}
+	var series []model.SeriesExemplars
+	switch protoMsg {
+	case protoMsgV2:
+		var req *writev2.Request
+		req, err = DecodeWriteV2Request(r.Body)
+		if err == nil {
+			series, err = writeV2RequestToSeriesExemplars(req)
+		}
+	default:
+		var req *prompb.WriteRequest
+		req, err = DecodeWriteRequest(r.Body)
+		if err == nil {
+			series = writeRequestToSeriesExemplars(req)
 		}
 	}
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Error decoding remote write request", "proto", protoMsg, "err", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := e.appendExemplars(r.Context(), series)
+	// Set on every response that went through the store, so senders know
+	// whether retrying a failed request writes exemplars twice. A failing
+	// store appends none of the exemplars of the request. Samples and
+	// histograms are never stored.
+	w.Header().Set(exemplarsWrittenHeader, strconv.Itoa(res.accepted))
+	w.Header().Set(samplesWrittenHeader, "0")
+	w.Header().Set(histogramsWrittenHeader, "0")
+	if err != nil {
+		// Storage failures are transient, respond with 5xx so that the
+		// sender retries the request.
+		level.Error(e.logger).Log("msg", "Error while adding exemplars in AppendExemplars", "series", len(series), "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	if res.numRejected() > 0 {
+		// Rejected exemplars will never be accepted, respond with 4xx so
+		// that the sender does not retry the request.
+		level.Warn(e.logger).Log("msg", "Rejected exemplars in remote write request", "summary", res.String())
+		http.Error(w, res.String(), http.StatusBadRequest)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// parseProtoMsg returns the protobuf message of a remote write request.
+// The proto parameter of the content type takes precedence, requests without
+// it are considered v1 unless the version header says otherwise.
+func parseProtoMsg(contentType, version string) (string, error) {
+	if contentType == "" {
+		if strings.HasPrefix(version, "2.") {
+			return protoMsgV2, nil
+		}
+		return protoMsgV1, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	if mediaType != "application/x-protobuf" {
+		return "", fmt.Errorf("unsupported content type %q", mediaType)
+	}
+
+	protoMsg, ok := params["proto"]
+	if !ok {
+		if strings.HasPrefix(version, "2.") {
+			return protoMsgV2, nil
+		}
+		return protoMsgV1, nil
+	}
+	switch protoMsg {
+	case protoMsgV1, protoMsgV2:
+		return protoMsg, nil
+	}
+	return "", fmt.Errorf("unsupported proto message %q", protoMsg)
+}
+
 // DecodeWriteRequest from an io.Reader into a prompb.WriteRequest, handling
 // snappy decompression.
 func DecodeWriteRequest(r io.Reader) (*prompb.WriteRequest, error) {
-	compressed, err := io.ReadAll(r)
+	reqBuf, err := decodeSnappy(r)
 	if err != nil {
 		return nil, err
 	}
 
-	reqBuf, err := snappy.Decode(nil, compressed)
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+// DecodeWriteV2Request from an io.Reader into a writev2.Request, handling
+// snappy decompression.
+func DecodeWriteV2Request(r io.Reader) (*writev2.Request, error) {
+	reqBuf, err := decodeSnappy(r)
 	if err != nil {
 		return nil, err
 	}
 
-	var req prompb.WriteRequest
-	if err := proto.Unmarshal(reqBuf, &req); err != nil {
+	var req writev2.Request
+	if err := req.Unmarshal(reqBuf); err != nil {
 		return nil, err
 	}
 
 	return &req, nil
 }
 
+func decodeSnappy(r io.Reader) ([]byte, error) {
+	compressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return snappy.Decode(nil, compressed)
+}
+
+func writeRequestToSeriesExemplars(req *prompb.WriteRequest) []model.SeriesExemplars {
+	series := make([]model.SeriesExemplars, 0, len(req.Timeseries))
+	for _, ts := range req.Timeseries {
+		if len(ts.Exemplars) == 0 {
+			continue
+		}
+		exemplars := make([]exemplar.Exemplar, 0, len(ts.Exemplars))
+		for _, ep := range ts.Exemplars {
+			exemplars = append(exemplars, exemplarProtoToExemplar(ep))
+		}
+		series = append(series, model.SeriesExemplars{
+			Labels:    labelProtosToLabels(ts.Labels),
+			Exemplars: exemplars,
+		})
+	}
+	return series
+}
+
+func writeV2RequestToSeriesExemplars(req *writev2.Request) ([]model.SeriesExemplars, error) {
+	series := make([]model.SeriesExemplars, 0, len(req.Timeseries))
+	for _, ts := range req.Timeseries {
+		if len(ts.Exemplars) == 0 {
+			continue
+		}
+		lset, err := req.Labels(ts.LabelsRefs)
+		if err != nil {
+			return nil, err
+		}
+		exemplars := make([]exemplar.Exemplar, 0, len(ts.Exemplars))
+		for _, ep := range ts.Exemplars {
+			elset, err := req.Labels(ep.LabelsRefs)
+			if err != nil {
+				return nil, err
+			}
+			exemplars = append(exemplars, exemplar.Exemplar{
+				Labels: elset,
+				Value:  ep.Value,
+				Ts:     ep.Timestamp,
+				HasTs:  ep.Timestamp != 0,
+			})
+		}
+		series = append(series, model.SeriesExemplars{
+			Labels:    lset,
+			Exemplars: exemplars,
+		})
+	}
+	return series, nil
+}
+
 func labelProtosToLabels(labelPairs []prompb.Label) labels.Labels {
 	b := labels.ScratchBuilder{}
 	for _, l := range labelPairs {
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func encodeWriteV1(t *testing.T) []byte {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{
+			Labels:    []prompb.Label{{Name: "__name__", Value: "foo"}, {Name: "job", Value: "api"}},
+			Exemplars: []prompb.Exemplar{{Labels: []prompb.Label{{Name: "trace_id", Value: "abc"}}, Value: 1, Timestamp: 1000}},
+		},
+		// Series without exemplars are skipped.
+		{Labels: []prompb.Label{{Name: "__name__", Value: "bar"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}},
+	}}
+	b, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snappy.Encode(nil, b)
+}
+
+// encodeWriteV2 encodes the same exemplars as encodeWriteV1 as a
+// io.prometheus.write.v2.Request.
+func encodeWriteV2() []byte {
+	appendRefs := func(b []byte, num protowire.Number, refs ...uint64) []byte {
+		var packed []byte
+		for _, ref := range refs {
+			packed = protowire.AppendVarint(packed, ref)
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, packed)
+	}
+
+	var ex []byte
+	ex = appendRefs(ex, 1, 5, 6)
+	ex = protowire.AppendTag(ex, 2, protowire.Fixed64Type)
+	ex = protowire.AppendFixed64(ex, math.Float64bits(1))
+	ex = protowire.AppendTag(ex, 3, protowire.VarintType)
+	ex = protowire.AppendVarint(ex, 1000)
+
+	var ts []byte
+	ts = appendRefs(ts, 1, 1, 2, 3, 4)
+	ts = protowire.AppendTag(ts, 4, protowire.BytesType)
+	ts = protowire.AppendBytes(ts, ex)
+
+	var req []byte
+	for _, s := range []string{"", "__name__", "foo", "job", "api", "trace_id", "abc"} {
+		req = protowire.AppendTag(req, 4, protowire.BytesType)
+		req = protowire.AppendString(req, s)
+	}
+	req = protowire.AppendTag(req, 5, protowire.BytesType)
+	req = protowire.AppendBytes(req, ts)
+	return snappy.Encode(nil, req)
+}
+
+func TestRemoteWrite(t *testing.T) {
+	v1, v2 := encodeWriteV1(t), encodeWriteV2()
+	want := []exemplar.QueryResult{{
+		SeriesLabels: labels.FromStrings("__name__", "foo", "job", "api"),
+		Exemplars:    []exemplar.Exemplar{{Labels: labels.FromStrings("trace_id", "abc"), Value: 1, Ts: 1000, HasTs: true}},
+	}}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		version     string
+		body        []byte
+		wantStatus  int
+	}{
+		{name: "v1 without content type", body: v1, wantStatus: http.StatusNoContent},
+		{name: "v1 without proto", contentType: "application/x-protobuf", version: "0.1.0", body: v1, wantStatus: http.StatusNoContent},
+		{name: "v1 proto", contentType: "application/x-protobuf;proto=prometheus.WriteRequest", version: "2.0.0", body: v1, wantStatus: http.StatusNoContent},
+		{name: "v2 proto", contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request", body: v2, wantStatus: http.StatusNoContent},
+		{name: "v2 version header", contentType: "application/x-protobuf", version: "2.0.0", body: v2, wantStatus: http.StatusNoContent},
+		{name: "v2 version header without content type", version: "2.0.0", body: v2, wantStatus: http.StatusNoContent},
+		{name: "unsupported media type", contentType: "application/json", body: v1, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "unsupported proto", contentType: "application/x-protobuf;proto=io.prometheus.write.v3.Request", body: v1, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "invalid content type", contentType: "application/x-protobuf;proto", body: v1, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "invalid v1", contentType: "application/x-protobuf;proto=prometheus.WriteRequest", body: snappy.Encode(nil, []byte{0xff}), wantStatus: http.StatusBadRequest},
+		{name: "invalid v2", contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request", body: snappy.Encode(nil, []byte{0xff}), wantStatus: http.StatusBadRequest},
+		{name: "not snappy", contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request", body: []byte("foo"), wantStatus: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newTestStore(t)
+			srv := newTestServer(store)
+
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			if tc.version != "" {
+				r.Header.Set(remoteWriteVersionHeader, tc.version)
+			}
+			w := httptest.NewRecorder()
+			srv.Mux.ServeHTTP(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantStatus != http.StatusNoContent {
+				if got := w.Header().Get(exemplarsWrittenHeader); got != "" {
+					t.Fatalf("unexpected %s header %q for a request that wasn't decoded", exemplarsWrittenHeader, got)
+				}
+				return
+			}
+			for header, want := range map[string]string{exemplarsWrittenHeader: "1", samplesWrittenHeader: "0", histogramsWrittenHeader: "0"} {
+				if got := w.Header().Get(header); got != want {
+					t.Fatalf("got %s header %q, want %s", header, got, want)
+				}
+			}
+			assertResults(t, selectAll(t, store), want)
+		})
+	}
+}
+
+func assertResults(t *testing.T, got, want []exemplar.QueryResult) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d series, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !labels.Equal(got[i].SeriesLabels, want[i].SeriesLabels) {
+			t.Fatalf("got series %s, want %s", got[i].SeriesLabels, want[i].SeriesLabels)
+		}
+		if len(got[i].Exemplars) != len(want[i].Exemplars) {
+			t.Fatalf("got %d exemplars for %s, want %d", len(got[i].Exemplars), want[i].SeriesLabels, len(want[i].Exemplars))
+		}
+		for j, e := range want[i].Exemplars {
+			if !e.Equals(got[i].Exemplars[j]) {
+				t.Fatalf("got exemplar %+v of %s, want %+v", got[i].Exemplars[j], want[i].SeriesLabels, e)
+			}
+		}
+	}
+}
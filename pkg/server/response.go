@@ -5,6 +5,8 @@ import (
 	"github.com/go-chi/render"
 	"github.com/pkg/errors"
 	"net/http"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
 )
 
 type response struct {
@@ -21,12 +23,16 @@ func (e *response) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func SuccessResponse(data interface{}) render.Renderer {
-	return &response{
+func SuccessResponse(data interface{}, warnings ...error) render.Renderer {
+	res := &response{
 		Status:         "success",
 		HTTPStatusCode: 200,
 		Data:           data,
 	}
+	for _, w := range warnings {
+		res.Warnings = append(res.Warnings, w.Error())
+	}
+	return res
 }
 
 func ErrBadData(err error) render.Renderer {
@@ -38,17 +44,33 @@ func ErrBadData(err error) render.Renderer {
 	}
 }
 
+// returnAPIErrorWrapper maps query errors to the error types of the
+// Prometheus API.
 func returnAPIErrorWrapper(err error) render.Renderer {
-	cause := errors.Unwrap(err)
-	if cause == nil {
-		cause = err
-	}
-	if errors.Is(err, context.Canceled) {
+	var (
+		limitErr *model.LimitError
+		execErr  *model.ExecutionError
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
 		return ErrCanceled(err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout(err)
+	case errors.As(err, &limitErr), errors.As(err, &execErr):
+		return ErrExecution(err)
 	}
 	return ErrInternal(err)
 }
 
+func ErrExecution(err error) render.Renderer {
+	return &response{
+		Status:         "error",
+		HTTPStatusCode: http.StatusUnprocessableEntity,
+		Error:          err.Error(),
+		ErrorType:      "execution",
+	}
+}
+
 func ErrInternal(err error) render.Renderer {
 	return &response{
 		Status:         "error",
@@ -58,6 +80,15 @@ func ErrInternal(err error) render.Renderer {
 	}
 }
 
+func ErrTimeout(err error) render.Renderer {
+	return &response{
+		Status:         "error",
+		HTTPStatusCode: http.StatusServiceUnavailable,
+		Error:          err.Error(),
+		ErrorType:      "timeout",
+	}
+}
+
 func ErrCanceled(err error) render.Renderer {
 	return &response{
 		Status:         "error",
@@ -3,9 +3,12 @@ package server
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
 	"github.com/go-kit/log"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/prometheus/model/exemplar"
@@ -13,49 +16,144 @@ import (
 	"github.com/thanos-io/thanos/pkg/exemplars/exemplarspb"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
 )
 
+// exemplarMatchMetadataKey is the gRPC metadata key holding selectors on
+// exemplar labels, the equivalent of the exemplar_match[] HTTP parameter.
+const exemplarMatchMetadataKey = "exemplar-match"
+
 type ExemplarServer struct {
-	store storage.ExemplarStore
+	store        storage.ExemplarStore
+	tenantHeader string
+	// traceLabel is the exemplar label holding the trace ID.
+	traceLabel string
+	// limits bounds the results of exemplar queries.
+	limits model.Limits
+	// retention is how long the store keeps exemplars, older ones are
+	// rejected.
+	retention time.Duration
 
 	logger log.Logger
 	reg    *prometheus.Registry
 	Mux    *chi.Mux
 }
 
-func NewExemplarServer(logger log.Logger, reg *prometheus.Registry, store storage.ExemplarStore) *ExemplarServer {
+// Option configures an ExemplarServer.
+type Option func(e *ExemplarServer)
+
+// WithTenantHeader sets the HTTP header and gRPC metadata key the tenant of a
+// request is read from. Defaults to tenancy.DefaultTenantHeader.
+func WithTenantHeader(header string) Option {
+	return func(e *ExemplarServer) {
+		e.tenantHeader = header
+	}
+}
+
+// WithTraceIDLabel sets the exemplar label trace lookups match the trace ID
+// against. Defaults to trace_id.
+func WithTraceIDLabel(name string) Option {
+	return func(e *ExemplarServer) {
+		e.traceLabel = name
+	}
+}
+
+// WithQueryLimits sets the limits of exemplar queries. Unlimited by
+// default.
+func WithQueryLimits(limits model.Limits) Option {
+	return func(e *ExemplarServer) {
+		e.limits = limits
+	}
+}
+
+// WithRetention rejects appended exemplars older than the retention of the
+// store. Exemplars of any age are accepted by default.
+func WithRetention(retention time.Duration) Option {
+	return func(e *ExemplarServer) {
+		e.retention = retention
+	}
+}
+
+func NewExemplarServer(logger log.Logger, reg *prometheus.Registry, store storage.ExemplarStore, opts ...Option) *ExemplarServer {
 	es := &ExemplarServer{
-		store:  store,
-		logger: logger,
-		reg:    reg,
+		store:        store,
+		tenantHeader: tenancy.DefaultTenantHeader,
+		traceLabel:   traceIDLabel,
+		logger:       logger,
+		reg:          reg,
+	}
+	for _, opt := range opts {
+		opt(es)
 	}
 	mux := chi.NewRouter()
 	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
 		promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
 	})
-	mux.Post("/api/v1/write", es.RemoteWrite)
-	mux.Post("/api/v1/query_exemplars", es.QueryExemplars)
-	mux.Get("/api/v1/query_exemplars", es.QueryExemplars)
+	mux.Group(func(mux chi.Router) {
+		mux.Use(es.tenantMiddleware)
+		mux.Post("/api/v1/write", es.RemoteWrite)
+		mux.Post("/v1/metrics", es.OTLPMetrics)
+		mux.Post("/api/v1/query_exemplars", es.QueryExemplars)
+		mux.Get("/api/v1/query_exemplars", es.QueryExemplars)
+		mux.Post("/api/v1/exemplars/topk", es.QueryTopKExemplars)
+		mux.Get("/api/v1/exemplars/topk", es.QueryTopKExemplars)
+		mux.Post("/api/v1/exemplars/density", es.QueryExemplarDensity)
+		mux.Get("/api/v1/exemplars/density", es.QueryExemplarDensity)
+		mux.Get("/api/v1/exemplars/trace/{trace_id}", es.QueryTraceExemplars)
+	})
 	es.Mux = mux
 	return es
 }
 
+// tenantMiddleware injects the tenant of the request header into the request
+// context. Requests without the header belong to tenancy.DefaultTenant.
+func (e *ExemplarServer) tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get(e.tenantHeader)
+		if tenant == "" {
+			tenant = tenancy.DefaultTenant
+		}
+		if err := tenancy.ValidateTenant(tenant); err != nil {
+			render.Render(w, r, ErrBadData(err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(tenancy.InjectTenant(r.Context(), tenant)))
+	})
+}
+
 func (e *ExemplarServer) Exemplars(r *exemplarspb.ExemplarsRequest, s exemplarspb.Exemplars_ExemplarsServer) error {
+	tenant, err := tenancy.TenantFromGRPCMetadata(s.Context(), e.tenantHeader)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	expr, err := parser.ParseExpr(r.Query)
 	if err != nil {
-		return status.Error(codes.Internal, err.Error())
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
 	matchers := parser.ExtractSelectors(expr)
-	results, err := e.store.Select(context.Background(), r.Start, r.End, matchers...)
+
+	// The Thanos exemplars request has no field for exemplar matchers, they
+	// are sent as metadata instead.
+	md, _ := metadata.FromIncomingContext(s.Context())
+	exemplarMatchers, err := parseExemplarMatchers(md.Get(exemplarMatchMetadataKey))
 	if err != nil {
-		return err
+		return status.Errorf(codes.InvalidArgument, "invalid metadata %s: %v", exemplarMatchMetadataKey, err)
 	}
 
-	for _, res := range results {
-		err = s.Send(&exemplarspb.ExemplarsResponse{
+	hints := &model.SelectHints{ExemplarMatchers: exemplarMatchers, Limits: e.limits}
+	valueRangeFromExpr(expr, hints)
+
+	// The stream context is canceled once the client is gone or its
+	// deadline is exceeded, which stops the select.
+	ctx := tenancy.InjectTenant(s.Context(), tenant)
+	warnings, err := e.store.SelectStream(ctx, r.Start, r.End, hints, func(res exemplar.QueryResult) error {
+		return s.Send(&exemplarspb.ExemplarsResponse{
 			Result: &exemplarspb.ExemplarsResponse_Data{Data: &exemplarspb.ExemplarData{
 				SeriesLabels: labelpb.ZLabelSet{
 					Labels: labelpb.ZLabelsFromPromLabels(res.SeriesLabels),
@@ -63,11 +161,39 @@ func (e *ExemplarServer) Exemplars(r *exemplarspb.ExemplarsRequest, s exemplarsp
 				Exemplars: exemplarsToThanosExemplars(res.Exemplars),
 			}},
 		})
+	}, matchers...)
+	if err != nil {
+		return grpcError(err)
 	}
 
+	// Warnings like truncated results are sent along the data, so Thanos
+	// can report them as partial responses.
+	for _, w := range warnings {
+		if err := s.Send(exemplarspb.NewWarningExemplarsResponse(w)); err != nil {
+			return grpcError(err)
+		}
+	}
 	return nil
 }
 
+// grpcError maps query errors to gRPC status errors, the gRPC equivalent of
+// returnAPIErrorWrapper.
+func grpcError(err error) error {
+	var limitErr *model.LimitError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.As(err, &limitErr):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
 func exemplarsToThanosExemplars(exemplars []exemplar.Exemplar) []*exemplarspb.Exemplar {
 	res := make([]*exemplarspb.Exemplar, 0, len(exemplars))
 	for _, e := range exemplars {
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/memory"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+)
+
+func newTestStore(t *testing.T) storage.ExemplarStore {
+	s, err := memory.NewMemoryStore(log.NewNopLogger(), prometheus.NewRegistry(), memory.Options{MaxExemplars: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func newTestServer(store storage.ExemplarStore, opts ...Option) *ExemplarServer {
+	return NewExemplarServer(log.NewNopLogger(), prometheus.NewRegistry(), store, opts...)
+}
+
+// failingStore fails every append and select with err.
+type failingStore struct {
+	storage.ExemplarStore
+	err error
+}
+
+func (s failingStore) AppendExemplars(context.Context, []model.SeriesExemplars) error {
+	return s.err
+}
+
+func (s failingStore) Select(context.Context, int64, int64, *model.SelectHints, ...[]*labels.Matcher) ([]exemplar.QueryResult, model.Warnings, error) {
+	return nil, nil, s.err
+}
+
+func (s failingStore) SelectStream(context.Context, int64, int64, *model.SelectHints, func(exemplar.QueryResult) error, ...[]*labels.Matcher) (model.Warnings, error) {
+	return nil, s.err
+}
+
+func (s failingStore) SelectTopK(context.Context, int64, int64, int, bool, *model.SelectHints, ...[]*labels.Matcher) ([]exemplar.QueryResult, error) {
+	return nil, s.err
+}
+
+func (s failingStore) SelectDensity(context.Context, int64, int64, int64, []float64, *model.SelectHints, ...[]*labels.Matcher) ([]model.SeriesDensity, error) {
+	return nil, s.err
+}
+
+func (s failingStore) SelectByTraceID(context.Context, int64, int64, string, string, model.Limits) ([]exemplar.QueryResult, error) {
+	return nil, s.err
+}
+
+// selectAll returns all exemplars of the default tenant.
+func selectAll(t *testing.T, s storage.ExemplarStore) []exemplar.QueryResult {
+	res, _, err := s.Select(context.Background(), 0, 1<<62, nil, []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
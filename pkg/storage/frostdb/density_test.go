@@ -0,0 +1,52 @@
+package frostdb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
+)
+
+// TestSelectDensityAggregation checks that densities counted with a FrostDB
+// aggregation equal the scanned ones. FrostDB fails to aggregate if
+// GOMAXPROCS was 1 when it was initialized, SelectDensity scans the
+// exemplars then.
+func TestSelectDensityAggregation(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	var series []model.SeriesExemplars
+	for i := 0; i < 3; i++ {
+		ss := model.SeriesExemplars{Labels: labels.FromStrings("__name__", "foo", "pod", fmt.Sprint(i))}
+		for ts := int64(0); ts < 100; ts += int64(i + 1) {
+			ss.Exemplars = append(ss.Exemplars, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", fmt.Sprint(ts)), Ts: ts, Value: 1, HasTs: true})
+		}
+		series = append(series, ss)
+	}
+	if err := s.AppendExemplars(ctx, series); err != nil {
+		t.Fatal(err)
+	}
+
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")}
+	aggregated, err := s.SelectDensity(ctx, 0, 100, 30, nil, nil, matchers)
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+
+	tt, err := s.tenantTable(ctx, tenancy.DefaultTenant, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	density := model.NewDensity(30, nil, model.Limits{})
+	if err := s.scanExemplars(ctx, tt, s.timeRangeExpr(0, 100), nil, filterSeries([][]*labels.Matcher{matchers}, addFunc(density.Add))); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if scanned := density.Results(); !reflect.DeepEqual(aggregated, scanned) {
+		t.Fatalf("aggregated %v, scanned %v", aggregated, scanned)
+	}
+}
@@ -0,0 +1,242 @@
+package frostdb
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/polarsignals/frostdb/query/logicalplan"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+)
+
+// Labels are stored in dynamic columns, a label a row doesn't have is null
+// and a label no row of a part has is missing from its schema. FrostDB
+// doesn't treat null and missing columns like empty values the way
+// Prometheus does, matchers matching the empty value are therefore not
+// pushed down but checked against the labels of the scanned rows.
+
+// promMatchersToFrostDBExprs translates the matchers into filters on the
+// dynamic columns of column, either ColumnLabels or ColumnExemplarLabels.
+// Only matchers that don't match the empty value are translated, nil is
+// returned if there are none.
+func promMatchersToFrostDBExprs(column string, matchers []*labels.Matcher) logicalplan.Expr {
+	exprs := []logicalplan.Expr{}
+	for _, matcher := range matchers {
+		if matcher.Matches("") {
+			continue
+		}
+		exprs = append(exprs, matcherExpr(logicalplan.Col(column+"."+matcher.Name), matcher))
+	}
+	return logicalplan.And(exprs...)
+}
+
+// matcherExpr translates a matcher not matching the empty value. Regexes
+// that are alternations of literals are rewritten to (in)equalities, which
+// FrostDB can check against the bloom filters of the row groups, and
+// regexes like foo.* and .+ to prefix and non-empty checks.
+func matcherExpr(col *logicalplan.Column, matcher *labels.Matcher) logicalplan.Expr {
+	switch matcher.Type {
+	case labels.MatchEqual:
+		return col.Eq(logicalplan.Literal(matcher.Value))
+	case labels.MatchNotEqual:
+		return col.NotEq(logicalplan.Literal(matcher.Value))
+	case labels.MatchRegexp:
+		if set := setMatches(matcher.Value); set != nil {
+			exprs := make([]logicalplan.Expr, 0, len(set))
+			for _, v := range set {
+				exprs = append(exprs, col.Eq(logicalplan.Literal(v)))
+			}
+			return logicalplan.Or(exprs...)
+		}
+		if p, ok := parsePrefixRegex(matcher.Value); ok {
+			return p.expr(col)
+		}
+		return col.RegexMatch(anchorRegex(matcher.Value))
+	case labels.MatchNotRegexp:
+		if set := setMatches(matcher.Value); set != nil {
+			exprs := make([]logicalplan.Expr, 0, len(set))
+			for _, v := range set {
+				exprs = append(exprs, col.NotEq(logicalplan.Literal(v)))
+			}
+			return logicalplan.And(exprs...)
+		}
+		return col.RegexNotMatch(anchorRegex(matcher.Value))
+	}
+	return nil
+}
+
+// setMatches returns the values matched by a regex that is an alternation
+// of literals like a|b|c, nil for any other regex.
+func setMatches(re string) []string {
+	var (
+		set     []string
+		value   strings.Builder
+		escaped bool
+	)
+	for i := 0; i < len(re); i++ {
+		c := re[i]
+		switch {
+		case escaped:
+			if !isRegexMetaCharacter(c) {
+				return nil
+			}
+			value.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '|':
+			set = append(set, value.String())
+			value.Reset()
+		case isRegexMetaCharacter(c):
+			return nil
+		default:
+			value.WriteByte(c)
+		}
+	}
+	if escaped {
+		return nil
+	}
+	return append(set, value.String())
+}
+
+func isRegexMetaCharacter(c byte) bool {
+	return strings.IndexByte(`\.+*?()|[]{}^$`, c) >= 0
+}
+
+// prefixRegex is a regex matching a literal prefix followed by any
+// characters, like foo.*, or any non-empty value, like .+.
+type prefixRegex struct {
+	prefix string
+	// nonEmpty is set for .+, which isn't supported after a prefix.
+	nonEmpty bool
+	// newlines is set if . matches newlines, with the s flag.
+	newlines bool
+}
+
+func parsePrefixRegex(re string) (prefixRegex, bool) {
+	r, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return prefixRegex{}, false
+	}
+	var p prefixRegex
+	if r.Op == syntax.OpConcat && len(r.Sub) == 2 && r.Sub[0].Op == syntax.OpLiteral && r.Sub[0].Flags&syntax.FoldCase == 0 {
+		p.prefix = string(r.Sub[0].Rune)
+		r = r.Sub[1]
+	}
+	if (r.Op != syntax.OpStar && r.Op != syntax.OpPlus) || len(r.Sub) != 1 {
+		return prefixRegex{}, false
+	}
+	p.nonEmpty = r.Op == syntax.OpPlus
+	switch r.Sub[0].Op {
+	case syntax.OpAnyChar:
+		p.newlines = true
+	case syntax.OpAnyCharNotNL:
+	default:
+		return prefixRegex{}, false
+	}
+	// foo.+ and .* aren't rewritten, the latter matches the empty value.
+	if p.nonEmpty == (p.prefix != "") {
+		return prefixRegex{}, false
+	}
+	return p, true
+}
+
+func (p prefixRegex) expr(col *logicalplan.Column) logicalplan.Expr {
+	var expr logicalplan.Expr
+	if p.nonEmpty {
+		// Null values don't match inequalities in FrostDB.
+		expr = col.NotEq(logicalplan.Literal(""))
+	} else {
+		expr = col.RegexMatch("^" + regexp.QuoteMeta(p.prefix))
+	}
+	if !p.newlines {
+		expr = logicalplan.And(expr, col.RegexNotMatch(`\n`))
+	}
+	return expr
+}
+
+// anchorRegex anchors a regex at both ends like PromQL does, FrostDB matches
+// regexes anywhere in the value.
+func anchorRegex(re string) string {
+	return "^(?:" + re + ")$"
+}
+
+// selectorsExpr returns the filter for rows matching any of the matcher
+// sets, nil if any of the sets can't be translated and all rows have to be
+// scanned.
+func selectorsExpr(column string, matcherSets [][]*labels.Matcher) logicalplan.Expr {
+	exprs := make([]logicalplan.Expr, 0, len(matcherSets))
+	for _, ms := range matcherSets {
+		expr := promMatchersToFrostDBExprs(column, ms)
+		if expr == nil {
+			return nil
+		}
+		exprs = append(exprs, expr)
+	}
+	return logicalplan.Or(exprs...)
+}
+
+// seriesExpr returns the filter for the rows of any of the series. It also
+// matches the rows of series with more labels, which have to be dropped
+// after scanning.
+func seriesExpr(column string, series []labels.Labels) logicalplan.Expr {
+	exprs := make([]logicalplan.Expr, 0, len(series))
+	for _, lset := range series {
+		labelExprs := make([]logicalplan.Expr, 0, len(lset))
+		for _, l := range lset {
+			labelExprs = append(labelExprs, logicalplan.Col(column+"."+l.Name).Eq(logicalplan.Literal(l.Value)))
+		}
+		exprs = append(exprs, logicalplan.And(labelExprs...))
+	}
+	return logicalplan.Or(exprs...)
+}
+
+// exemplarMatchersExpr returns the filter for the exemplar matchers of the
+// hints, nil if there are none.
+func exemplarMatchersExpr(hints *model.SelectHints) logicalplan.Expr {
+	if hints == nil {
+		return nil
+	}
+	return selectorsExpr(ColumnExemplarLabels, hints.ExemplarMatchers)
+}
+
+// pushedDown returns whether all matchers are translated to filters, so
+// FrostDB selects exactly the rows matching the matcher sets.
+func pushedDown(matcherSets [][]*labels.Matcher) bool {
+	for _, ms := range matcherSets {
+		for _, m := range ms {
+			if m.Matches("") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchesAny returns whether lset matches all matchers of any of the
+// matcher sets.
+func matchesAny(lset labels.Labels, matcherSets [][]*labels.Matcher) bool {
+	for _, ms := range matcherSets {
+		if model.Matches(lset, ms) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterSeries wraps fn to only pass the exemplars of series matching any of
+// the matcher sets, if FrostDB can't filter the series exactly.
+func filterSeries(matcherSets [][]*labels.Matcher, fn func(labels.Labels, exemplar.Exemplar) error) func(labels.Labels, exemplar.Exemplar) error {
+	if pushedDown(matcherSets) {
+		return fn
+	}
+	return func(lset labels.Labels, e exemplar.Exemplar) error {
+		if !matchesAny(lset, matcherSets) {
+			return nil
+		}
+		return fn(lset, e)
+	}
+}
@@ -0,0 +1,234 @@
+package frostdb
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v10/arrow/scalar"
+	"github.com/go-kit/log"
+	"github.com/polarsignals/frostdb/query/logicalplan"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+)
+
+func newTestStore(t testing.TB) *FrostDBStore {
+	s, err := NewFrostDBStore(log.NewNopLogger(), trace.NewNoopTracerProvider().Tracer(""), prometheus.NewRegistry(), "exemplars", Options{
+		DataDir: t.TempDir(),
+		Bucket:  objstore.NewInMemBucket(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// matcherTestValues are label values matchers are tested against, the empty
+// value stands for a missing label.
+var matcherTestValues = []string{"a", "b", "ab", "ba", "abc", "A", "a.b", "a\nb", "\n", ""}
+
+// TestMatchers checks that series and exemplars are selected exactly like
+// labels.Matcher.Matches selects them, a missing label matching like the
+// empty value.
+func TestMatchers(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	// Every series has its value in the label v, its exemplar in the
+	// exemplar label e.
+	var series []model.SeriesExemplars
+	for i, v := range matcherTestValues {
+		lset := labels.FromStrings("__name__", "foo", "i", string(rune('a'+i)))
+		exemplarLabels := labels.FromStrings("trace_id", "abc")
+		if v != "" {
+			lset = labels.NewBuilder(lset).Set("v", v).Labels(nil)
+			exemplarLabels = labels.NewBuilder(exemplarLabels).Set("e", v).Labels(nil)
+		}
+		series = append(series, model.SeriesExemplars{
+			Labels:    lset,
+			Exemplars: []exemplar.Exemplar{{Labels: exemplarLabels, Value: 1, Ts: 1, HasTs: true}},
+		})
+	}
+	if err := s.AppendExemplars(ctx, series); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		mType labels.MatchType
+		value string
+	}{
+		{name: "equal", mType: labels.MatchEqual, value: "a"},
+		{name: "equal empty", mType: labels.MatchEqual, value: ""},
+		{name: "not equal", mType: labels.MatchNotEqual, value: "a"},
+		{name: "not equal empty", mType: labels.MatchNotEqual, value: ""},
+		{name: "regex anchored", mType: labels.MatchRegexp, value: "b"},
+		{name: "regex anchored alternation", mType: labels.MatchRegexp, value: "a|b"},
+		{name: "regex anchored wildcard", mType: labels.MatchRegexp, value: ".b"},
+		{name: "regex literal dot", mType: labels.MatchRegexp, value: `a\.b`},
+		{name: "regex matching empty", mType: labels.MatchRegexp, value: "a|"},
+		{name: "regex matching all", mType: labels.MatchRegexp, value: ".*"},
+		{name: "regex case insensitive", mType: labels.MatchRegexp, value: "(?i)a"},
+		{name: "regex not matching newlines", mType: labels.MatchRegexp, value: "a.*"},
+		{name: "regex matching newlines", mType: labels.MatchRegexp, value: "(?s)a.*"},
+		{name: "regex non empty", mType: labels.MatchRegexp, value: ".+"},
+		{name: "not regex", mType: labels.MatchNotRegexp, value: "a"},
+		{name: "not regex anchored", mType: labels.MatchNotRegexp, value: "b"},
+		{name: "not regex alternation", mType: labels.MatchNotRegexp, value: "a|b"},
+		{name: "not regex empty", mType: labels.MatchNotRegexp, value: ""},
+		{name: "not regex non empty", mType: labels.MatchNotRegexp, value: ".+"},
+		{name: "not regex matching empty", mType: labels.MatchNotRegexp, value: "a|"},
+		{name: "not regex wildcard", mType: labels.MatchNotRegexp, value: "a.*"},
+		{name: "not regex case insensitive", mType: labels.MatchNotRegexp, value: "(?i)b"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := labels.MustNewMatcher(tc.mType, "v", tc.value)
+			var want []string
+			for _, v := range matcherTestValues {
+				if m.Matches(v) {
+					want = append(want, v)
+				}
+			}
+
+			res, _, err := s.Select(ctx, 0, math.MaxInt64, nil, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo"), m})
+			if err != nil {
+				t.Fatal(err)
+			}
+			requireValues(t, "series", want, res, func(r exemplar.QueryResult) string { return r.SeriesLabels.Get("v") })
+
+			res, _, err = s.Select(ctx, 0, math.MaxInt64, &model.SelectHints{
+				ExemplarMatchers: [][]*labels.Matcher{{labels.MustNewMatcher(tc.mType, "e", tc.value)}},
+			}, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			requireValues(t, "exemplars", want, res, func(r exemplar.QueryResult) string { return r.Exemplars[0].Labels.Get("e") })
+		})
+	}
+}
+
+// requireValues fails the test if the values of the selected results aren't
+// want.
+func requireValues(t *testing.T, what string, want []string, res []exemplar.QueryResult, value func(exemplar.QueryResult) string) {
+	t.Helper()
+	got := make([]string, 0, len(res))
+	for _, r := range res {
+		got = append(got, value(r))
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") || len(got) != len(want) {
+		t.Fatalf("selected %s with values %q, want %q", what, got, want)
+	}
+}
+
+// TestMatcherExpr checks the rewrites of regex matchers, and that the
+// rewritten filters match the same values as the anchored regex.
+func TestMatcherExpr(t *testing.T) {
+	values := append([]string{"foo", "foobar", "foo\n", "\nfoo", "fo.o", "fo.ox", "FOO", "c", "a|b", `a\b`}, matcherTestValues...)
+	for _, tc := range []struct {
+		name    string
+		matcher *labels.Matcher
+		want    string
+	}{
+		{name: "alternation", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "a|b|c"), want: `labels.v == "a" || labels.v == "b" || labels.v == "c"`},
+		{name: "single literal", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "foo"), want: `labels.v == "foo"`},
+		{name: "escaped metacharacters", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", `a\.b|a\|b|a\\b`), want: `labels.v == "a.b" || labels.v == "a|b" || labels.v == "a\\b"`},
+		{name: "newline literal", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "a\nb|b"), want: `labels.v == "a\nb" || labels.v == "b"`},
+		{name: "negated alternation", matcher: labels.MustNewMatcher(labels.MatchNotRegexp, "v", "a|b"), want: `labels.v != "a" && labels.v != "b"`},
+		{name: "negated alternation with empty value", matcher: labels.MustNewMatcher(labels.MatchNotRegexp, "v", "|a"), want: `labels.v != "" && labels.v != "a"`},
+		{name: "alternation with group", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "a|(b)"), want: `labels.v =~ "^(?:a|(b))$"`},
+		{name: "alternation with repetition", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "a|b+"), want: `labels.v =~ "^(?:a|b+)$"`},
+		{name: "escaped character class", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", `a\d|b`), want: `labels.v =~ "^(?:a\\d|b)$"`},
+		{name: "case insensitive alternation", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "(?i)a|b"), want: `labels.v =~ "^(?:(?i)a|b)$"`},
+		{name: "prefix", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "foo.*"), want: `labels.v =~ "^foo" && labels.v !~ "\\n"`},
+		{name: "prefix matching newlines", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "(?s)foo.*"), want: `labels.v =~ "^foo"`},
+		{name: "prefix with metacharacters", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", `fo\.o.*`), want: `labels.v =~ "^fo\\.o" && labels.v !~ "\\n"`},
+		{name: "non empty", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", ".+"), want: `labels.v != "" && labels.v !~ "\\n"`},
+		{name: "non empty matching newlines", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "(?s).+"), want: `labels.v != ""`},
+		{name: "prefix non empty", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "foo.+"), want: `labels.v =~ "^(?:foo.+)$"`},
+		{name: "case insensitive prefix", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "(?i)foo.*"), want: `labels.v =~ "^(?:(?i)foo.*)$"`},
+		{name: "prefix and suffix", matcher: labels.MustNewMatcher(labels.MatchRegexp, "v", "foo.*bar"), want: `labels.v =~ "^(?:foo.*bar)$"`},
+		{name: "negated prefix", matcher: labels.MustNewMatcher(labels.MatchNotRegexp, "v", "foo.*"), want: `labels.v !~ "^(?:foo.*)$"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expr := matcherExpr(logicalplan.Col(ColumnLabels+".v"), tc.matcher)
+			if got := exprString(expr); got != tc.want {
+				t.Fatalf("rewrote %s to %s, want %s", tc.matcher, got, tc.want)
+			}
+
+			re := regexp.MustCompile(anchorRegex(tc.matcher.Value))
+			for _, v := range values {
+				// Missing labels are null in FrostDB, matchers matching
+				// the empty value aren't rewritten.
+				if v == "" {
+					continue
+				}
+				want := re.MatchString(v) == (tc.matcher.Type == labels.MatchRegexp)
+				if got := evalExpr(expr, v); got != want {
+					t.Errorf("%s matches %q: %t, the regex: %t", exprString(expr), v, got, want)
+				}
+			}
+		})
+	}
+}
+
+// exprString formats a filter on a single column.
+func exprString(expr logicalplan.Expr) string {
+	switch e := expr.(type) {
+	case *logicalplan.BinaryExpr:
+		if e.Op != logicalplan.OpAnd && e.Op != logicalplan.OpOr {
+			return exprString(e.Left) + " " + e.Op.String() + " " + exprString(e.Right)
+		}
+		operand := func(o logicalplan.Expr) string {
+			if b, ok := o.(*logicalplan.BinaryExpr); ok && (b.Op == logicalplan.OpAnd || b.Op == logicalplan.OpOr) && b.Op != e.Op {
+				return "(" + exprString(o) + ")"
+			}
+			return exprString(o)
+		}
+		return operand(e.Left) + " " + e.Op.String() + " " + operand(e.Right)
+	case *logicalplan.Column:
+		return e.ColumnName
+	case *logicalplan.LiteralExpr:
+		return strconv.Quote(literalString(e))
+	}
+	return "unknown"
+}
+
+// evalExpr evaluates a filter on a single column against its value v, like
+// FrostDB evaluates it against a non-null value.
+func evalExpr(expr logicalplan.Expr, v string) bool {
+	e := expr.(*logicalplan.BinaryExpr)
+	switch e.Op {
+	case logicalplan.OpAnd:
+		return evalExpr(e.Left, v) && evalExpr(e.Right, v)
+	case logicalplan.OpOr:
+		return evalExpr(e.Left, v) || evalExpr(e.Right, v)
+	}
+	lit := literalString(e.Right.(*logicalplan.LiteralExpr))
+	switch e.Op {
+	case logicalplan.OpEq:
+		return v == lit
+	case logicalplan.OpNotEq:
+		return v != lit
+	case logicalplan.OpRegexMatch:
+		return regexp.MustCompile(lit).MatchString(v)
+	case logicalplan.OpRegexNotMatch:
+		return !regexp.MustCompile(lit).MatchString(v)
+	}
+	panic("unexpected operator " + e.Op.String())
+}
+
+func literalString(e *logicalplan.LiteralExpr) string {
+	return string(e.Value.(*scalar.String).Value.Bytes())
+}
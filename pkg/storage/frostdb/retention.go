@@ -0,0 +1,250 @@
+package frostdb
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/segmentio/parquet-go"
+)
+
+const (
+	retentionInterval = time.Minute
+	// maxBlockDuration is the longest time a block stays active with
+	// retention. Rotating blocks by time partitions the persisted blocks by
+	// time, so retention can drop whole blocks.
+	maxBlockDuration = 2 * time.Hour
+
+	blockFileName = "data.parquet"
+)
+
+var (
+	errMissingTimestamps  = errors.New("block has no timestamps")
+	errMissingColumnIndex = errors.New("block has no column index")
+)
+
+type retentionMetrics struct {
+	oldestTimestamp prometheus.Gauge
+	reclaimedBytes  prometheus.Counter
+	deletedBlocks   prometheus.Counter
+	runsFailed      prometheus.Counter
+}
+
+func newRetentionMetrics(reg prometheus.Registerer) *retentionMetrics {
+	return &retentionMetrics{
+		oldestTimestamp: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "exemplars_retention_oldest_timestamp_seconds",
+			Help: "Oldest exemplar timestamp kept in persisted blocks after the last retention run.",
+		}),
+		reclaimedBytes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "exemplars_retention_reclaimed_bytes_total",
+			Help: "Total size of the blocks deleted by retention.",
+		}),
+		deletedBlocks: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "exemplars_retention_deleted_blocks_total",
+			Help: "Total number of blocks deleted by retention.",
+		}),
+		runsFailed: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "exemplars_retention_runs_failed_total",
+			Help: "Total number of failed retention runs.",
+		}),
+	}
+}
+
+// blockDuration returns how long a block stays active before it is rotated,
+// 0 if blocks are only rotated once they are full. With retention, blocks
+// have to be considerably shorter than the retention to not keep expired
+// data around for too long.
+func (s *FrostDBStore) blockDuration() time.Duration {
+	d := s.opts.BlockPersistInterval
+	if s.opts.Retention > 0 {
+		rd := s.opts.Retention / 4
+		if rd > maxBlockDuration {
+			rd = maxBlockDuration
+		}
+		if d <= 0 || rd < d {
+			d = rd
+		}
+	}
+	return d
+}
+
+// minValidTime returns the timestamp of the oldest exemplar still within
+// retention.
+func (s *FrostDBStore) minValidTime() int64 {
+	if s.opts.Retention <= 0 {
+		return math.MinInt64
+	}
+	return timestamp.FromTime(time.Now().Add(-s.opts.Retention))
+}
+
+// runRetention applies retention every retentionInterval until ctx is
+// canceled.
+func (s *FrostDBStore) runRetention(ctx context.Context) {
+	defer close(s.retentionDone)
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.applyRetention(ctx); err != nil && ctx.Err() == nil {
+				level.Error(s.logger).Log("msg", "failed to apply retention", "err", err)
+				s.retentionMetrics.runsFailed.Inc()
+			}
+		}
+	}
+}
+
+// rotateBlock rotates the active block of the table if it has been active
+// for longer than the block duration. It is called right before inserting
+// into the table, so the new active block isn't left empty.
+func (s *FrostDBStore) rotateBlock(t *tenantTable) error {
+	// Without a bucket rotated blocks are dropped.
+	d := s.blockDuration()
+	if s.bucket == nil || d <= 0 {
+		return nil
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if time.Since(t.activeSince) < d {
+		return nil
+	}
+	// Empty blocks can't be persisted.
+	if active := t.table.ActiveBlock(); active.Size() > 0 {
+		if err := t.table.RotateBlock(active); err != nil {
+			return err
+		}
+	}
+	t.activeSince = time.Now()
+	return nil
+}
+
+// blockRange is the minimum and maximum exemplar timestamp of a block.
+type blockRange struct {
+	minTime, maxTime int64
+}
+
+// applyRetention deletes all persisted blocks of all databases whose newest
+// exemplar is older than the retention. The time ranges of the blocks are
+// read once and cached.
+func (s *FrostDBStore) applyRetention(ctx context.Context) error {
+	minValidTime := s.minValidTime()
+	oldest := int64(math.MaxInt64)
+
+	var dbs []string
+	if err := s.bucket.Iter(ctx, "", func(name string) error {
+		if strings.HasSuffix(name, "/") {
+			dbs = append(dbs, name)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Only the ranges of blocks that are still there are kept.
+	ranges := make(map[string]blockRange, len(s.blockRanges))
+	for _, db := range dbs {
+		var blocks []string
+		if err := s.bucket.Iter(ctx, path.Join(db, tableName), func(name string) error {
+			blocks = append(blocks, name)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, block := range blocks {
+			blockFile := path.Join(block, blockFileName)
+			r, ok := s.blockRanges[blockFile]
+			if !ok {
+				var err error
+				if r, err = s.blockTimeRange(ctx, blockFile); err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					level.Warn(s.logger).Log("msg", "failed to read block time range, keeping block", "block", block, "err", err)
+					continue
+				}
+			}
+			if r.maxTime >= minValidTime {
+				ranges[blockFile] = r
+				if r.minTime < oldest {
+					oldest = r.minTime
+				}
+				continue
+			}
+
+			attrs, err := s.bucket.Attributes(ctx, blockFile)
+			if err != nil {
+				return err
+			}
+			if err := s.bucket.Delete(ctx, blockFile); err != nil {
+				return err
+			}
+			level.Info(s.logger).Log("msg", "deleted block outside of retention", "block", block, "maxTime", r.maxTime)
+			s.retentionMetrics.deletedBlocks.Inc()
+			s.retentionMetrics.reclaimedBytes.Add(float64(attrs.Size))
+		}
+	}
+
+	s.blockRanges = ranges
+	if oldest == math.MaxInt64 {
+		oldest = minValidTime
+	}
+	s.retentionMetrics.oldestTimestamp.Set(float64(oldest) / 1000)
+	return nil
+}
+
+// blockTimeRange returns the time range of a block from the column index of
+// the timestamp column of its parquet file. Only the footer and the page
+// index of the file are read, not its pages.
+func (s *FrostDBStore) blockTimeRange(ctx context.Context, name string) (blockRange, error) {
+	attrs, err := s.bucket.Attributes(ctx, name)
+	if err != nil {
+		return blockRange{}, err
+	}
+	r, err := s.bucket.GetReaderAt(ctx, name)
+	if err != nil {
+		return blockRange{}, err
+	}
+	f, err := parquet.OpenFile(r, attrs.Size, parquet.SkipBloomFilters(true))
+	if err != nil {
+		return blockRange{}, err
+	}
+	col, ok := f.Schema().Lookup(ColumnTimestamp)
+	if !ok {
+		return blockRange{}, errMissingTimestamps
+	}
+
+	br := blockRange{minTime: math.MaxInt64, maxTime: math.MinInt64}
+	for _, rg := range f.RowGroups() {
+		index := rg.ColumnChunks()[col.ColumnIndex].ColumnIndex()
+		if index == nil {
+			return blockRange{}, errMissingColumnIndex
+		}
+		for i := 0; i < index.NumPages(); i++ {
+			if index.NullPage(i) {
+				continue
+			}
+			if v := index.MinValue(i).Int64(); v < br.minTime {
+				br.minTime = v
+			}
+			if v := index.MaxValue(i).Int64(); v > br.maxTime {
+				br.maxTime = v
+			}
+		}
+	}
+	if br.minTime > br.maxTime {
+		return blockRange{}, errMissingTimestamps
+	}
+	return br, nil
+}
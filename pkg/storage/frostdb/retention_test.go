@@ -0,0 +1,67 @@
+package frostdb
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/thanos-io/objstore"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
+)
+
+// TestApplyRetention checks that retention deletes the blocks outside of
+// retention and reads the time range of every block once.
+func TestApplyRetention(t *testing.T) {
+	bkt := objstore.NewInMemBucket()
+	s, err := NewFrostDBStore(log.NewNopLogger(), trace.NewNoopTracerProvider().Tracer(""), prometheus.NewRegistry(), "exemplars", Options{
+		DataDir:   t.TempDir(),
+		Retention: time.Hour,
+		Bucket:    bkt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := timestamp.FromTime(time.Now())
+	ctx := context.Background()
+	for tenant, ts := range map[string]int64{"old": now - 2*time.Hour.Milliseconds(), "new": now} {
+		if err := s.AppendExemplar(tenancy.InjectTenant(ctx, tenant), labels.FromStrings("__name__", "foo"), exemplar.Exemplar{Ts: ts, Value: 1, HasTs: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Persists the active blocks.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.applyRetention(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(s.retentionMetrics.deletedBlocks); n != 1 {
+		t.Fatalf("deleted %v blocks, want 1", n)
+	}
+	if len(s.blockRanges) != 1 {
+		t.Fatalf("got cached ranges %v, want the kept block only", s.blockRanges)
+	}
+
+	// A cached range isn't read again.
+	for name := range s.blockRanges {
+		if err := bkt.Upload(ctx, name, strings.NewReader("corrupt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.applyRetention(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := testutil.ToFloat64(s.retentionMetrics.oldestTimestamp), float64(now)/1000; got != want {
+		t.Fatalf("got oldest timestamp %v, want %v", got, want)
+	}
+}
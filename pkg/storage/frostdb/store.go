@@ -2,8 +2,14 @@ package frostdb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/apache/arrow/go/v10/arrow"
 	"github.com/apache/arrow/go/v10/arrow/array"
@@ -14,36 +20,112 @@ import (
 	"github.com/polarsignals/frostdb/dynparquet"
 	"github.com/polarsignals/frostdb/query"
 	"github.com/polarsignals/frostdb/query/logicalplan"
+	frostdbstorage "github.com/polarsignals/frostdb/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/model/exemplar"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/segmentio/parquet-go"
+	"github.com/thanos-io/objstore"
 	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
 )
 
 const (
 	tableName = "exemplars"
+	// tenantDBPrefix prefixes the database names of tenants, so no tenant
+	// can name the database of the default tenant.
+	tenantDBPrefix = "tenant-"
 )
 
+// streamBatchSeries is how many series SelectStream scans at once.
+const streamBatchSeries = 100
+
+// errLimitReached stops a scan once a limit of the select is reached.
+var errLimitReached = errors.New("limit reached")
+
+// Options configures the FrostDB store.
+type Options struct {
+	// DataDir is the directory the WAL is kept in.
+	DataDir string
+	// EnableWAL enables the write-ahead log, without it the exemplars of
+	// the active blocks are lost on restart.
+	EnableWAL bool
+	// ActiveMemorySize is the size in bytes of the active block of a table
+	// after which it is rotated and persisted. FrostDB's default if 0.
+	ActiveMemorySize int64
+	// GranuleSize is the size in bytes after which granules are split.
+	// FrostDB's default if 0.
+	GranuleSize int64
+	// BlockPersistInterval is how long a block stays active before it is
+	// rotated and persisted by the next append. Blocks are only rotated once
+	// they are full if 0.
+	BlockPersistInterval time.Duration
+	// Retention is how long exemplars are kept, forever if 0.
+	Retention time.Duration
+	// Bucket is the bucket blocks are persisted to and queried from.
+	// Optional, without it exemplars are only kept in the active blocks and
+	// the WAL, and are dropped once an active block is full. Retention
+	// isn't applied then.
+	Bucket objstore.Bucket
+}
+
 type FrostDBStore struct {
-	table  *frostdb.Table
+	logger log.Logger
+	opts   Options
+	store  *frostdb.ColumnStore
+	// bucket is nil if the store has no bucket.
+	bucket frostdbstorage.Bucket
 	schema *dynparquet.Schema
+	// defaultDB is the database of tenancy.DefaultTenant.
+	defaultDB string
+
+	mtx     sync.RWMutex
+	tenants map[string]*tenantTable
+
+	retentionMetrics *retentionMetrics
+	retentionCancel  context.CancelFunc
+	retentionDone    chan struct{}
+	// blockRanges caches the time ranges of the persisted blocks by their
+	// path, blocks are immutable. Only used by the retention loop.
+	blockRanges map[string]blockRange
+}
+
+// tenantTable is the exemplars table in the database of a single tenant.
+type tenantTable struct {
+	db *frostdb.DB
+	// table is nil until the tenant appends, reads use the persisted table
+	// of the database then.
+	table  *frostdb.Table
 	engine *query.LocalEngine
+
+	mtx sync.Mutex
+	// activeSince is when the active block of the table was created.
+	activeSince time.Time
 }
 
-func NewFrostDBStore(logger log.Logger, tracer trace.Tracer, reg prometheus.Registerer, dbName string) (*FrostDBStore, error) {
-	store, err := frostdb.New(
+// NewFrostDBStore creates a FrostDB backed store.
+func NewFrostDBStore(logger log.Logger, tracer trace.Tracer, reg prometheus.Registerer, dbName string, opts Options) (*FrostDBStore, error) {
+	frostdbOpts := []frostdb.Option{
 		frostdb.WithLogger(logger),
 		frostdb.WithRegistry(reg),
 		frostdb.WithTracer(tracer),
-		frostdb.WithWAL(),
-		frostdb.WithStoragePath("data"),
-	)
-	if err != nil {
-		return nil, err
+		frostdb.WithStoragePath(opts.DataDir),
+	}
+	if opts.Bucket != nil {
+		frostdbOpts = append(frostdbOpts, frostdb.WithBucketStorage(opts.Bucket))
+	}
+	if opts.EnableWAL {
+		frostdbOpts = append(frostdbOpts, frostdb.WithWAL())
+	}
+	if opts.ActiveMemorySize > 0 {
+		frostdbOpts = append(frostdbOpts, frostdb.WithActiveMemorySize(opts.ActiveMemorySize))
 	}
-	ctx := context.TODO()
-	db, err := store.DB(ctx, dbName)
+	if opts.GranuleSize > 0 {
+		frostdbOpts = append(frostdbOpts, frostdb.WithGranuleSizeBytes(opts.GranuleSize))
+	}
+	store, err := frostdb.New(frostdbOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -57,32 +139,153 @@ func NewFrostDBStore(logger log.Logger, tracer trace.Tracer, reg prometheus.Regi
 		return nil, err
 	}
 
-	engine := query.NewEngine(memory.DefaultAllocator, db.TableProvider())
-	table, err := db.Table(
-		tableName,
-		frostdb.NewTableConfig(schema),
-	)
-	if err != nil {
-		return nil, err
+	s := &FrostDBStore{
+		logger:           logger,
+		opts:             opts,
+		store:            store,
+		schema:           schema,
+		defaultDB:        dbName,
+		tenants:          map[string]*tenantTable{},
+		retentionMetrics: newRetentionMetrics(reg),
+		blockRanges:      map[string]blockRange{},
+	}
+	if opts.Bucket != nil {
+		s.bucket = frostdbstorage.NewBucketReaderAt(opts.Bucket)
+	}
+	if s.bucket != nil && opts.Retention > 0 {
+		var ctx context.Context
+		ctx, s.retentionCancel = context.WithCancel(context.Background())
+		s.retentionDone = make(chan struct{})
+		go s.runRetention(ctx)
+	}
+	return s, nil
+}
+
+// Close stops retention and closes all databases, which persists their
+// active blocks to the bucket and closes their WALs. Tables are created and
+// rotated right before inserts, so no active block is empty, which FrostDB
+// fails to persist.
+func (s *FrostDBStore) Close() error {
+	if s.retentionCancel != nil {
+		s.retentionCancel()
+		<-s.retentionDone
 	}
-	return &FrostDBStore{
-		table:  table,
-		schema: schema,
-		engine: engine,
-	}, nil
+	return s.store.Close()
+}
+
+// tenantTable returns the table of the given tenant. With create, databases
+// and tables are created lazily on first use, otherwise nil is returned for
+// tenants without any exemplars. The default tenant uses the database the
+// store was created with, other tenants their name prefixed with
+// tenantDBPrefix.
+func (s *FrostDBStore) tenantTable(ctx context.Context, tenant string, create bool) (*tenantTable, error) {
+	s.mtx.RLock()
+	t, ok := s.tenants[tenant]
+	ok = ok && (t.table != nil || !create)
+	s.mtx.RUnlock()
+	if ok {
+		return t, nil
+	}
+
+	dbName := s.defaultDB
+	if tenant != tenancy.DefaultTenant {
+		if err := tenancy.ValidateTenant(tenant); err != nil {
+			return nil, err
+		}
+		dbName = tenantDBPrefix + tenant
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	t, ok = s.tenants[tenant]
+	if !ok {
+		if !create {
+			exists, err := s.dbExists(ctx, dbName)
+			if err != nil || !exists {
+				return nil, err
+			}
+		}
+		db, err := s.store.DB(ctx, dbName)
+		if err != nil {
+			return nil, err
+		}
+		// Databases whose exemplars were all dropped have no table.
+		if _, err := db.TableProvider().GetTable(tableName); err != nil && !create {
+			return nil, nil
+		}
+		t = &tenantTable{
+			db:     db,
+			engine: query.NewEngine(memory.DefaultAllocator, db.TableProvider()),
+		}
+		s.tenants[tenant] = t
+	}
+	if create && t.table == nil {
+		table, err := t.db.Table(
+			tableName,
+			frostdb.NewTableConfig(s.schema),
+		)
+		if err != nil {
+			return nil, err
+		}
+		t.table = table
+		t.mtx.Lock()
+		t.activeSince = time.Now()
+		t.mtx.Unlock()
+	}
+	return t, nil
+}
+
+// dbExists returns whether the database has a WAL or persisted blocks,
+// without opening it.
+func (s *FrostDBStore) dbExists(ctx context.Context, dbName string) (bool, error) {
+	if s.opts.EnableWAL {
+		_, err := os.Stat(filepath.Join(s.store.DatabasesDir(), dbName))
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	if s.bucket == nil {
+		return false, nil
+	}
+	var exists bool
+	err := s.bucket.Iter(ctx, dbName, func(string) error {
+		exists = true
+		return nil
+	})
+	return exists, err
 }
 
 func (s *FrostDBStore) AppendExemplar(ctx context.Context, lset labels.Labels, e exemplar.Exemplar) error {
-	dynamicColumnLabels := make([]string, 0, len(lset))
-	dynamicColumnExemplarLabels := make([]string, 0, len(e.Labels))
-	row := make([]parquet.Value, 0, len(lset)+len(e.Labels))
-	for _, lbl := range lset {
-		dynamicColumnLabels = append(dynamicColumnLabels, lbl.Name)
+	return s.AppendExemplars(ctx, []model.SeriesExemplars{{Labels: lset, Exemplars: []exemplar.Exemplar{e}}})
+}
+
+// AppendExemplars writes all exemplars of the given series with a single
+// insert. The buffer is created over the union of the dynamic label columns
+// of the batch, labels missing from a row are written as nulls.
+func (s *FrostDBStore) AppendExemplars(ctx context.Context, series []model.SeriesExemplars) error {
+	labelNames := map[string]struct{}{}
+	exemplarLabelNames := map[string]struct{}{}
+	numRows := 0
+	for _, ss := range series {
+		for _, lbl := range ss.Labels {
+			labelNames[lbl.Name] = struct{}{}
+		}
+		for _, e := range ss.Exemplars {
+			for _, lbl := range e.Labels {
+				exemplarLabelNames[lbl.Name] = struct{}{}
+			}
+		}
+		numRows += len(ss.Exemplars)
 	}
-	for _, lbl := range e.Labels {
-		dynamicColumnExemplarLabels = append(dynamicColumnExemplarLabels, lbl.Name)
+	if numRows == 0 {
+		return nil
 	}
 
+	dynamicColumnLabels := sortedKeys(labelNames)
+	dynamicColumnExemplarLabels := sortedKeys(exemplarLabelNames)
 	buf, err := s.schema.NewBuffer(map[string][]string{
 		ColumnLabels:         dynamicColumnLabels,
 		ColumnExemplarLabels: dynamicColumnExemplarLabels,
@@ -91,6 +294,39 @@ func (s *FrostDBStore) AppendExemplar(ctx context.Context, lset labels.Labels, e
 		return err
 	}
 
+	rows := make([]parquet.Row, 0, numRows)
+	for _, ss := range series {
+		for _, e := range ss.Exemplars {
+			rows = append(rows, s.exemplarRow(dynamicColumnLabels, dynamicColumnExemplarLabels, ss.Labels, e))
+		}
+	}
+
+	if _, err = buf.WriteRows(rows); err != nil {
+		return err
+	}
+	buf.Sort()
+
+	// Tables are only created and rotated once there are rows to insert,
+	// FrostDB fails to persist empty blocks.
+	t, err := s.tenantTable(ctx, tenancy.TenantFromContext(ctx), true)
+	if err != nil {
+		return err
+	}
+	if err := s.rotateBlock(t); err != nil {
+		return err
+	}
+	if _, err = t.table.InsertBuffer(ctx, buf); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// exemplarRow builds the parquet row of a single exemplar for a buffer with
+// the given dynamic columns.
+func (s *FrostDBStore) exemplarRow(labelNames, exemplarLabelNames []string, lset labels.Labels, e exemplar.Exemplar) parquet.Row {
+	row := make([]parquet.Value, 0, len(labelNames)+len(exemplarLabelNames)+2)
+
 	// schema.Columns() returns a sorted list of all columns.
 	// We match on the column's name to insert the correct values.
 	// We track the columnIndex to insert each column at the correct index.
@@ -98,15 +334,9 @@ func (s *FrostDBStore) AppendExemplar(ctx context.Context, lset labels.Labels, e
 	for _, column := range s.schema.Columns() {
 		switch column.Name {
 		case ColumnLabels:
-			for _, v := range lset {
-				row = append(row, parquet.ValueOf(v.Value).Level(0, 1, columnIndex))
-				columnIndex++
-			}
+			row = appendLabelValues(row, labelNames, lset, &columnIndex)
 		case ColumnExemplarLabels:
-			for _, v := range e.Labels {
-				row = append(row, parquet.ValueOf(v.Value).Level(0, 1, columnIndex))
-				columnIndex++
-			}
+			row = appendLabelValues(row, exemplarLabelNames, e.Labels, &columnIndex)
 		case ColumnTimestamp:
 			row = append(row, parquet.ValueOf(e.Ts).Level(0, 0, columnIndex))
 			columnIndex++
@@ -116,135 +346,526 @@ func (s *FrostDBStore) AppendExemplar(ctx context.Context, lset labels.Labels, e
 		default:
 		}
 	}
+	return row
+}
 
-	if _, err = buf.WriteRows([]parquet.Row{row}); err != nil {
-		return err
+// appendLabelValues appends one value per dynamic column name. Both names and
+// lset have to be sorted. Names not present in lset are appended as nulls.
+func appendLabelValues(row []parquet.Value, names []string, lset labels.Labels, columnIndex *int) []parquet.Value {
+	i := 0
+	for _, name := range names {
+		if i < len(lset) && lset[i].Name == name {
+			row = append(row, parquet.ValueOf(lset[i].Value).Level(0, 1, *columnIndex))
+			i++
+		} else {
+			row = append(row, parquet.ValueOf(nil).Level(0, 0, *columnIndex))
+		}
+		*columnIndex++
 	}
+	return row
+}
 
-	if _, err = s.table.InsertBuffer(ctx, buf); err != nil {
-		return err
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	return nil
+// Select scans the table once for all selectors, filtering the series
+// matching any of them. This reads every row at most once, and a series
+// matched by several selectors is returned only once. The kept exemplars,
+// thinned if the hints have a step, are accounted against the limits of the
+// hints while scanning, the scan stops once a limit is reached.
+func (s *FrostDBStore) Select(ctx context.Context, start, end int64, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, model.Warnings, error) {
+	t, err := s.tenantTable(ctx, tenancy.TenantFromContext(ctx), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t == nil || len(matchers) == 0 {
+		return []exemplar.QueryResult{}, nil, nil
+	}
+
+	limiter := hints.NewLimiter()
+	series := newSeriesCollector(hints, limiter)
+	err = s.scanExemplars(ctx, t, logicalplan.And(
+		s.timeRangeExpr(start, end),
+		selectorsExpr(ColumnLabels, matchers),
+		exemplarMatchersExpr(hints),
+	), hints, filterSeries(matchers, series.add))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := limiter.Err(); err != nil {
+		return nil, nil, err
+	}
+	return series.results(), limiter.Warnings(), nil
+}
+
+// SelectStream passes the series of Select to fn one by one, in the same
+// order. Scanned rows aren't ordered by series, so the matching series are
+// resolved first, and then scanned and passed to fn in batches of
+// streamBatchSeries series. Only the exemplars of a single batch are kept in
+// memory. Series passed to fn before a limit is reached aren't taken back.
+func (s *FrostDBStore) SelectStream(ctx context.Context, start, end int64, hints *model.SelectHints, fn func(exemplar.QueryResult) error, matchers ...[]*labels.Matcher) (model.Warnings, error) {
+	t, err := s.tenantTable(ctx, tenancy.TenantFromContext(ctx), false)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil || len(matchers) == 0 {
+		return nil, nil
+	}
+
+	series, err := s.selectSeries(ctx, t, start, end, hints, matchers)
+	if err != nil {
+		return nil, err
+	}
+	limiter := hints.NewLimiter()
+	for len(series) > 0 && !limiter.Reached() {
+		batch := series
+		if len(batch) > streamBatchSeries {
+			batch = batch[:streamBatchSeries]
+		}
+		series = series[len(batch):]
+
+		// The filter of the batch also matches series with more labels.
+		index := model.NewSeriesIndex()
+		for _, lset := range batch {
+			index.Add(lset)
+		}
+		collector := newSeriesCollector(hints, limiter)
+		err := s.scanExemplars(ctx, t, logicalplan.And(
+			s.timeRangeExpr(start, end),
+			seriesExpr(ColumnLabels, batch),
+			exemplarMatchersExpr(hints),
+		), hints, func(lbls labels.Labels, e exemplar.Exemplar) error {
+			if _, ok := index.Get(lbls); !ok {
+				return nil
+			}
+			return collector.add(lbls, e)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := limiter.Err(); err != nil {
+			return nil, err
+		}
+		if err := model.StreamResults(ctx, collector.results(), fn); err != nil {
+			return nil, err
+		}
+	}
+	return limiter.Warnings(), nil
+}
+
+// selectSeries returns the labels of the series with exemplars matching the
+// selectors and the exemplar matchers of the hints, sorted.
+func (s *FrostDBStore) selectSeries(ctx context.Context, t *tenantTable, start, end int64, hints *model.SelectHints, matchers [][]*labels.Matcher) ([]labels.Labels, error) {
+	index := model.NewSeriesIndex()
+	var series []labels.Labels
+	err := t.engine.ScanTable(tableName).
+		Filter(logicalplan.And(
+			s.timeRangeExpr(start, end),
+			selectorsExpr(ColumnLabels, matchers),
+			exemplarMatchersExpr(hints),
+		)).
+		Distinct(logicalplan.DynCol(ColumnLabels)).
+		Execute(ctx, func(ctx context.Context, r arrow.Record) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			for i := 0; i < int(r.NumRows()); i++ {
+				lbls := labels.Labels{}
+				for j := 0; j < int(r.NumCols()); j++ {
+					dict, ok := r.Column(j).(*array.Dictionary)
+					if !ok {
+						return fmt.Errorf("expected dictionary column, got %T", r.Column(j))
+					}
+					if dict.IsNull(i) {
+						continue
+					}
+					if val := StringValueFromDictionary(dict, i); len(val) > 0 {
+						lbls = append(lbls, labels.Label{Name: strings.TrimPrefix(r.ColumnName(j), "labels."), Value: val})
+					}
+				}
+				if !pushedDown(matchers) && !matchesAny(lbls, matchers) {
+					continue
+				}
+				// Distinct rows of concurrent scans may repeat a series.
+				if _, added := index.Add(lbls); added {
+					series = append(series, lbls)
+				}
+			}
+			return nil
+		})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		return nil, &model.ExecutionError{Err: err}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return labels.Compare(series[i], series[j]) < 0
+	})
+	return series, nil
+}
+
+// SelectTopK returns the k exemplars with the highest values of all series
+// matching any of the matcher sets, or the k highest of every series if
+// perSeries is true. The exemplars are collected while scanning, only k
+// exemplars per heap are kept in memory and accounted against the limits of
+// the hints.
+func (s *FrostDBStore) SelectTopK(ctx context.Context, start, end int64, k int, perSeries bool, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, error) {
+	t, err := s.tenantTable(ctx, tenancy.TenantFromContext(ctx), false)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil || len(matchers) == 0 {
+		return []exemplar.QueryResult{}, nil
+	}
+
+	// Scan all selectors at once so exemplars of series matched by several
+	// selectors are only seen once.
+	topK := model.NewTopK(k, perSeries, hints.GetLimits())
+	if err := s.scanExemplars(ctx, t, logicalplan.And(
+		s.timeRangeExpr(start, end),
+		selectorsExpr(ColumnLabels, matchers),
+		exemplarMatchersExpr(hints),
+	), hints, filterSeries(matchers, addFunc(topK.Add))); err != nil {
+		return nil, err
+	}
+	if err := topK.Err(); err != nil {
+		return nil, err
+	}
+	return topK.Results(), nil
+}
+
+// SelectDensity counts the exemplars per series and step with a FrostDB
+// aggregation on the timestamp column. FrostDB can't aggregate double
+// columns, so the exemplars are scanned instead if quantiles of their values
+// are requested or the hints limit their values. The values kept for
+// quantiles are bounded by the limits of the hints.
+func (s *FrostDBStore) SelectDensity(ctx context.Context, start, end, step int64, quantiles []float64, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]model.SeriesDensity, error) {
+	t, err := s.tenantTable(ctx, tenancy.TenantFromContext(ctx), false)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil || len(matchers) == 0 {
+		return []model.SeriesDensity{}, nil
+	}
+	filter := logicalplan.And(
+		s.timeRangeExpr(start, end),
+		selectorsExpr(ColumnLabels, matchers),
+		exemplarMatchersExpr(hints),
+	)
+
+	// The aggregation can't check exemplar labels that aren't filtered by
+	// FrostDB.
+	if len(quantiles) == 0 && !hints.HasValueRange() && (hints == nil || pushedDown(hints.ExemplarMatchers)) {
+		density := model.NewDensity(step, quantiles, hints.GetLimits())
+		err := s.aggregateDensity(ctx, t, filter, step, matchers, density)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err == nil || errors.Is(err, errLimitReached) {
+			if err := density.Err(); err != nil {
+				return nil, err
+			}
+			return density.Results(), nil
+		}
+		// FrostDB fixes the concurrency of its plans to GOMAXPROCS when it is
+		// initialized, and with a single CPU fails to find the column to
+		// aggregate. The exemplars are scanned instead.
+		level.Debug(s.logger).Log("msg", "failed to aggregate density, scanning exemplars", "err", err)
+	}
+
+	density := model.NewDensity(step, quantiles, hints.GetLimits())
+	if err := s.scanExemplars(ctx, t, filter, hints, filterSeries(matchers, addFunc(density.Add))); err != nil {
+		return nil, err
+	}
+	if err := density.Err(); err != nil {
+		return nil, err
+	}
+	return density.Results(), nil
 }
 
-func (s *FrostDBStore) Select(ctx context.Context, start, end int64, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, error) {
-	seriesSet := map[uint64]*exemplar.QueryResult{}
-	for _, matcher := range matchers {
-		s.engine.ScanTable(tableName).
-			Filter(logicalplan.And(
-				logicalplan.And(
-					logicalplan.Col(ColumnTimestamp).Gt(logicalplan.Literal(start)),
-					logicalplan.Col(ColumnTimestamp).Lt(logicalplan.Literal(end)),
-				),
-				promMatchersToFrostDBExprs(matcher),
-			)).
-			Project(
+// aggregateDensity counts the exemplars matching filter per series and step
+// with a FrostDB aggregation and adds the counts to density. It returns
+// errLimitReached once density is full.
+func (s *FrostDBStore) aggregateDensity(ctx context.Context, t *tenantTable, filter logicalplan.Expr, step int64, matchers [][]*labels.Matcher, density *model.Density) error {
+	return t.engine.ScanTable(tableName).
+		Filter(filter).
+		Aggregate(
+			[]logicalplan.Expr{logicalplan.Count(logicalplan.Col(ColumnTimestamp))},
+			[]logicalplan.Expr{
 				logicalplan.DynCol(ColumnLabels),
-				logicalplan.DynCol(ColumnExemplarLabels),
-				logicalplan.Col(ColumnTimestamp),
-				logicalplan.Col(ColumnValue),
-			).
-			Execute(ctx, func(ctx context.Context, r arrow.Record) error {
-				var ts int64
-				var v float64
-				for i := 0; i < int(r.NumRows()); i++ {
-					lbls := labels.Labels{}
-					exemplarLabels := labels.Labels{}
-					for j := 0; j < int(r.NumCols()); j++ {
-						switch {
-						case r.ColumnName(j) == ColumnTimestamp:
-							ts = r.Column(j).(*array.Int64).Value(i)
-						case r.ColumnName(j) == ColumnValue:
-							v = r.Column(j).(*array.Float64).Value(i)
-						case strings.HasPrefix(r.ColumnName(j), "labels."):
-							name := strings.TrimPrefix(r.ColumnName(j), "labels.")
-							dict, ok := r.Column(j).(*array.Dictionary)
-							if !ok {
-								return fmt.Errorf("expected dictionary column, got %T", r.Column(j))
-							}
-
-							if dict.IsNull(i) {
-								continue
-							}
-
-							val := StringValueFromDictionary(dict, i)
-
-							// Because of an implementation detail of aggregations in
-							// FrostDB resulting columns can have the value of "", but that
-							// is equivalent to the label not existing at all, so we need
-							// to skip it.
-							if len(val) > 0 {
-								lbls = append(lbls, labels.Label{Name: name, Value: val})
-							}
-						default:
-							name := strings.TrimPrefix(r.ColumnName(j), "exemplar_labels.")
-							dict, ok := r.Column(j).(*array.Dictionary)
-							if !ok {
-								return fmt.Errorf("expected dictionary column, got %T", r.Column(j))
-							}
-
-							if dict.IsNull(i) {
-								continue
-							}
-
-							val := StringValueFromDictionary(dict, i)
-
-							// Because of an implementation detail of aggregations in
-							// FrostDB resulting columns can have the value of "", but that
-							// is equivalent to the label not existing at all, so we need
-							// to skip it.
-							if len(val) > 0 {
-								exemplarLabels = append(exemplarLabels, labels.Label{Name: name, Value: val})
-							}
+				logicalplan.Duration(time.Duration(step) * time.Millisecond),
+			},
+		).
+		Execute(ctx, func(ctx context.Context, r arrow.Record) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var ts, count int64
+			for i := 0; i < int(r.NumRows()); i++ {
+				lbls := labels.Labels{}
+				for j := 0; j < int(r.NumCols()); j++ {
+					switch {
+					case r.ColumnName(j) == ColumnTimestamp:
+						// The timestamp of any exemplar of the bucket.
+						ts = r.Column(j).(*array.Int64).Value(i)
+					case strings.HasPrefix(r.ColumnName(j), "labels."):
+						dict, ok := r.Column(j).(*array.Dictionary)
+						if !ok {
+							return fmt.Errorf("expected dictionary column, got %T", r.Column(j))
+						}
+						if dict.IsNull(i) {
+							continue
 						}
+						if val := StringValueFromDictionary(dict, i); len(val) > 0 {
+							lbls = append(lbls, labels.Label{Name: strings.TrimPrefix(r.ColumnName(j), "labels."), Value: val})
+						}
+					default:
+						count = r.Column(j).(*array.Int64).Value(i)
 					}
-					h := lbls.Hash()
-					if es, ok := seriesSet[h]; ok {
-						es.Exemplars = append(es.Exemplars, exemplar.Exemplar{
-							Labels: exemplarLabels,
-							Ts:     ts,
-							Value:  v,
-						})
-					} else {
-						seriesSet[h] = &exemplar.QueryResult{
-							SeriesLabels: lbls,
-							Exemplars: []exemplar.Exemplar{
-								{
-									Labels: exemplarLabels,
-									Ts:     ts,
-									Value:  v,
-								},
-							},
+				}
+				if (pushedDown(matchers) || matchesAny(lbls, matchers)) && !density.AddCount(lbls, ts, count) {
+					return errLimitReached
+				}
+			}
+			return nil
+		})
+}
+
+// SelectByTraceID returns all exemplars whose exemplar label traceIDLabel is
+// traceID, grouped by series. The scan stops once a limit is reached.
+func (s *FrostDBStore) SelectByTraceID(ctx context.Context, start, end int64, traceIDLabel, traceID string, limits model.Limits) ([]exemplar.QueryResult, error) {
+	t, err := s.tenantTable(ctx, tenancy.TenantFromContext(ctx), false)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return []exemplar.QueryResult{}, nil
+	}
+
+	// Without warnings, truncated results can't be told from complete ones.
+	limits.Truncate = false
+	limiter := model.NewLimiter(limits)
+	series := newSeriesSet()
+	err = s.scanExemplars(ctx, t, logicalplan.And(
+		s.timeRangeExpr(start, end),
+		logicalplan.Col(ColumnExemplarLabels+"."+traceIDLabel).Eq(logicalplan.Literal(traceID)),
+	), nil, addFunc(func(lbls labels.Labels, e exemplar.Exemplar) bool {
+		if !limiter.Add(lbls, e) {
+			return false
+		}
+		series.add(lbls, e)
+		return true
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if err := limiter.Err(); err != nil {
+		return nil, err
+	}
+	return series.results(false), nil
+}
+
+// timeRangeExpr returns the filter for exemplars between start and end,
+// both inclusive.
+func (s *FrostDBStore) timeRangeExpr(start, end int64) logicalplan.Expr {
+	// Blocks are only dropped once all of their exemplars are outside of
+	// retention, hide the expired exemplars still kept.
+	if minValidTime := s.minValidTime(); start < minValidTime {
+		start = minValidTime
+	}
+	return logicalplan.And(
+		logicalplan.Col(ColumnTimestamp).GtEq(logicalplan.Literal(start)),
+		logicalplan.Col(ColumnTimestamp).LtEq(logicalplan.Literal(end)),
+	)
+}
+
+// scanExemplars scans the table of a tenant with the given filter and calls
+// fn for every exemplar found. The scan stops on the first error of fn or
+// once ctx is done, failures are returned as *model.ExecutionError. FrostDB
+// can't filter on double columns, so the value range of the hints is
+// applied to the scanned rows instead, like the exemplar matchers that
+// aren't pushed down.
+func (s *FrostDBStore) scanExemplars(ctx context.Context, t *tenantTable, filter logicalplan.Expr, hints *model.SelectHints, fn func(lbls labels.Labels, e exemplar.Exemplar) error) error {
+	exemplarsPushedDown := hints == nil || pushedDown(hints.ExemplarMatchers)
+	err := t.engine.ScanTable(tableName).
+		Filter(filter).
+		Project(
+			logicalplan.DynCol(ColumnLabels),
+			logicalplan.DynCol(ColumnExemplarLabels),
+			logicalplan.Col(ColumnTimestamp),
+			logicalplan.Col(ColumnValue),
+		).
+		Execute(ctx, func(ctx context.Context, r arrow.Record) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var ts int64
+			var v float64
+			for i := 0; i < int(r.NumRows()); i++ {
+				lbls := labels.Labels{}
+				exemplarLabels := labels.Labels{}
+				for j := 0; j < int(r.NumCols()); j++ {
+					switch {
+					case r.ColumnName(j) == ColumnTimestamp:
+						ts = r.Column(j).(*array.Int64).Value(i)
+					case r.ColumnName(j) == ColumnValue:
+						v = r.Column(j).(*array.Float64).Value(i)
+					case strings.HasPrefix(r.ColumnName(j), "labels."):
+						name := strings.TrimPrefix(r.ColumnName(j), "labels.")
+						dict, ok := r.Column(j).(*array.Dictionary)
+						if !ok {
+							return fmt.Errorf("expected dictionary column, got %T", r.Column(j))
+						}
+
+						if dict.IsNull(i) {
+							continue
+						}
+
+						val := StringValueFromDictionary(dict, i)
+
+						// Because of an implementation detail of aggregations in
+						// FrostDB resulting columns can have the value of "", but that
+						// is equivalent to the label not existing at all, so we need
+						// to skip it.
+						if len(val) > 0 {
+							lbls = append(lbls, labels.Label{Name: name, Value: val})
+						}
+					default:
+						name := strings.TrimPrefix(r.ColumnName(j), "exemplar_labels.")
+						dict, ok := r.Column(j).(*array.Dictionary)
+						if !ok {
+							return fmt.Errorf("expected dictionary column, got %T", r.Column(j))
+						}
+
+						if dict.IsNull(i) {
+							continue
+						}
+
+						val := StringValueFromDictionary(dict, i)
+
+						// Because of an implementation detail of aggregations in
+						// FrostDB resulting columns can have the value of "", but that
+						// is equivalent to the label not existing at all, so we need
+						// to skip it.
+						if len(val) > 0 {
+							exemplarLabels = append(exemplarLabels, labels.Label{Name: name, Value: val})
 						}
 					}
 				}
-				return nil
-			})
+				if !hints.MatchesValue(v) || (!exemplarsPushedDown && !hints.MatchesExemplarLabels(exemplarLabels)) {
+					continue
+				}
+				if err := fn(lbls, exemplar.Exemplar{
+					Labels: exemplarLabels,
+					Ts:     ts,
+					Value:  v,
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	// Canceled scans may end without an error before any record is read.
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err == nil || errors.Is(err, errLimitReached) {
+		return nil
+	}
+	return &model.ExecutionError{Err: err}
+}
+
+// addFunc adapts the Add method of a collector to a scanExemplars callback,
+// stopping the scan once the collector reached a limit.
+func addFunc(add func(labels.Labels, exemplar.Exemplar) bool) func(labels.Labels, exemplar.Exemplar) error {
+	return func(lbls labels.Labels, e exemplar.Exemplar) error {
+		if !add(lbls, e) {
+			return errLimitReached
+		}
+		return nil
 	}
+}
+
+// seriesCollector collects the exemplars of a select by series, thinned if
+// the hints have a step, and accounts the kept exemplars against a limiter.
+type seriesCollector struct {
+	descending bool
+	limiter    *model.Limiter
+	thinner    *model.StepThinner
+	series     *seriesSet
+}
 
-	res := make([]exemplar.QueryResult, 0, len(seriesSet))
-	for _, v := range seriesSet {
-		res = append(res, *v)
+func newSeriesCollector(hints *model.SelectHints, limiter *model.Limiter) *seriesCollector {
+	c := &seriesCollector{
+		descending: hints.IsDescending(),
+		limiter:    limiter,
+		series:     newSeriesSet(),
 	}
-	return res, nil
+	if hints.Thinned() {
+		c.thinner = model.NewStepThinner(hints.Step, hints.MaxPerStep, limiter)
+	}
+	return c
 }
 
-func promMatchersToFrostDBExprs(matchers []*labels.Matcher) logicalplan.Expr {
-	exprs := []logicalplan.Expr{}
-	for _, matcher := range matchers {
-		switch matcher.Type {
-		case labels.MatchEqual:
-			exprs = append(exprs, logicalplan.Col("labels."+matcher.Name).Eq(logicalplan.Literal(matcher.Value)))
-		case labels.MatchNotEqual:
-			exprs = append(exprs, logicalplan.Col("labels."+matcher.Name).NotEq(logicalplan.Literal(matcher.Value)))
-		case labels.MatchRegexp:
-			exprs = append(exprs, logicalplan.Col("labels."+matcher.Name).RegexMatch(matcher.Value))
-		case labels.MatchNotRegexp:
-			exprs = append(exprs, logicalplan.Col("labels."+matcher.Name).RegexNotMatch(matcher.Value))
+// add is a scanExemplars callback, it stops the scan once a limit is
+// reached.
+func (c *seriesCollector) add(lbls labels.Labels, e exemplar.Exemplar) error {
+	if c.thinner != nil {
+		if !c.thinner.Add(lbls, e) {
+			return errLimitReached
 		}
+		return nil
+	}
+	if !c.limiter.Add(lbls, e) {
+		return errLimitReached
+	}
+	c.series.add(lbls, e)
+	return nil
+}
+
+// results returns the collected series sorted like model.SortResults.
+func (c *seriesCollector) results() []exemplar.QueryResult {
+	if c.thinner != nil {
+		return c.thinner.Results(c.descending)
+	}
+	return c.series.results(c.descending)
+}
+
+// seriesSet groups scanned exemplars by series.
+type seriesSet struct {
+	index  *model.SeriesIndex
+	series []exemplar.QueryResult
+}
+
+func newSeriesSet() *seriesSet {
+	return &seriesSet{index: model.NewSeriesIndex()}
+}
+
+func (s *seriesSet) add(lset labels.Labels, e exemplar.Exemplar) {
+	i, added := s.index.Add(lset)
+	if added {
+		s.series = append(s.series, exemplar.QueryResult{SeriesLabels: lset})
+	}
+	s.series[i].Exemplars = append(s.series[i].Exemplars, e)
+}
+
+// results returns the series sorted like model.SortResults.
+func (s *seriesSet) results(descending bool) []exemplar.QueryResult {
+	res := s.series
+	if res == nil {
+		res = []exemplar.QueryResult{}
 	}
-	return logicalplan.And(exprs...)
+	model.SortResults(res, descending)
+	return res
 }
 
 func StringValueFromDictionary(arr *array.Dictionary, i int) string {
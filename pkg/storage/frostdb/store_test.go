@@ -0,0 +1,345 @@
+package frostdb_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/thanos-io/objstore"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/frostdb"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/storage/storetest"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
+)
+
+func testOptions(t testing.TB) frostdb.Options {
+	return frostdb.Options{
+		DataDir:   t.TempDir(),
+		EnableWAL: true,
+		Bucket:    objstore.NewInMemBucket(),
+	}
+}
+
+func newTestStore(t testing.TB, opts frostdb.Options) *frostdb.FrostDBStore {
+	s, err := frostdb.NewFrostDBStore(log.NewNopLogger(), trace.NewNoopTracerProvider().Tracer(""), prometheus.NewRegistry(), "exemplars", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.TestExemplarStore(t, func(t *testing.T) storage.ExemplarStore {
+		return newTestStore(t, testOptions(t))
+	})
+}
+
+// TestTenantIsolation checks that no tenant sees the exemplars of another,
+// including tenants named like the database of the default tenant.
+func TestTenantIsolation(t *testing.T) {
+	s := newTestStore(t, testOptions(t))
+	defer s.Close()
+
+	tenants := []string{tenancy.DefaultTenant, "exemplars", "tenant-exemplars", "a", "b"}
+	for _, tenant := range tenants {
+		ctx := tenancy.InjectTenant(context.Background(), tenant)
+		if err := s.AppendExemplar(ctx, labels.FromStrings("__name__", "foo", "tenant", tenant), exemplar.Exemplar{Ts: 1, Value: 1, HasTs: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tenant := range tenants {
+		ctx := tenancy.InjectTenant(context.Background(), tenant)
+		res, _, err := s.Select(ctx, 0, 10, nil, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 || res[0].SeriesLabels.Get("tenant") != tenant {
+			t.Fatalf("tenant %s selected %v, want only its own series", tenant, res)
+		}
+	}
+}
+
+// TestCloseReopen checks that the exemplars appended before Close are there
+// after reopening the store, and that tenants that never appended any
+// aren't created by reads.
+func TestCloseReopen(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		enableWAL bool
+		noBucket  bool
+	}{
+		{name: "wal", enableWAL: true},
+		{name: "no wal", enableWAL: false},
+		// The exemplars are replayed from the WAL.
+		{name: "wal without bucket", enableWAL: true, noBucket: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := testOptions(t)
+			opts.EnableWAL = tc.enableWAL
+			if tc.noBucket {
+				opts.Bucket = nil
+			}
+			matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")}
+
+			s := newTestStore(t, opts)
+			for _, tenant := range []string{tenancy.DefaultTenant, "a"} {
+				ctx := tenancy.InjectTenant(context.Background(), tenant)
+				if err := s.AppendExemplar(ctx, labels.FromStrings("__name__", "foo"), exemplar.Exemplar{Ts: 1, Value: 1, HasTs: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Reads don't create tenants.
+			res, _, err := s.Select(tenancy.InjectTenant(context.Background(), "b"), 0, 10, nil, matchers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) != 0 {
+				t.Fatalf("unknown tenant selected %v", res)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// Closing a database with a bucket persists its active block and
+			// removes its WAL.
+			if tc.enableWAL && !tc.noBucket {
+				for _, db := range []string{"exemplars", "tenant-a"} {
+					if _, err := os.Stat(filepath.Join(opts.DataDir, "databases", db, "wal")); !os.IsNotExist(err) {
+						t.Fatalf("got WAL of database %s after Close: %v", db, err)
+					}
+				}
+			}
+			if _, err := os.Stat(filepath.Join(opts.DataDir, "databases", "tenant-b")); !os.IsNotExist(err) {
+				t.Fatalf("got WAL of unknown tenant: %v", err)
+			}
+			if opts.Bucket != nil {
+				if err := opts.Bucket.Iter(context.Background(), "tenant-b", func(name string) error {
+					return fmt.Errorf("got block of unknown tenant: %s", name)
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s = newTestStore(t, opts)
+			defer s.Close()
+			for tenant, want := range map[string]int{tenancy.DefaultTenant: 1, "a": 1, "b": 0} {
+				res, _, err := s.Select(tenancy.InjectTenant(context.Background(), tenant), 0, 10, nil, matchers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(res) != want {
+					t.Fatalf("tenant %s selected %v after reopening, want %d series", tenant, res, want)
+				}
+			}
+		})
+	}
+}
+
+// TestBlockRotation checks that blocks active for longer than the block
+// persist interval are rotated by the next append, and that Close persists
+// the active block.
+func TestBlockRotation(t *testing.T) {
+	opts := testOptions(t)
+	opts.BlockPersistInterval = time.Millisecond
+	s := newTestStore(t, opts)
+	ctx := context.Background()
+
+	for ts := int64(1); ts <= 2; ts++ {
+		time.Sleep(opts.BlockPersistInterval)
+		if err := s.AppendExemplar(ctx, labels.FromStrings("__name__", "foo"), exemplar.Exemplar{Ts: ts, Value: 1, HasTs: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocks := func() int {
+		n := 0
+		if err := opts.Bucket.Iter(ctx, "exemplars/exemplars", func(string) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	// Rotated blocks are persisted in the background.
+	for deadline := time.Now().Add(5 * time.Second); blocks() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated block wasn't persisted")
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := blocks(); n != 2 {
+		t.Fatalf("got %d blocks after Close, want 2", n)
+	}
+}
+
+// TestSelectStreamBatches checks that SelectStream passes the same series as
+// Select if they are scanned in several batches, and that the limits apply
+// across batches.
+func TestSelectStreamBatches(t *testing.T) {
+	s := newTestStore(t, testOptions(t))
+	defer s.Close()
+	ctx := context.Background()
+
+	// The series without a pod label is matched by the filter of every batch.
+	series := []model.SeriesExemplars{{Labels: labels.FromStrings("__name__", "foo")}}
+	for i := 0; i < 250; i++ {
+		series = append(series, model.SeriesExemplars{Labels: labels.FromStrings("__name__", "foo", "pod", fmt.Sprint(i))})
+	}
+	for i := range series {
+		for ts := int64(1); ts <= 2; ts++ {
+			series[i].Exemplars = append(series[i].Exemplars, exemplar.Exemplar{Ts: ts, Value: float64(i), HasTs: true})
+		}
+	}
+	if err := s.AppendExemplars(ctx, series); err != nil {
+		t.Fatal(err)
+	}
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")}
+	stream := func(hints *model.SelectHints) ([]exemplar.QueryResult, model.Warnings, error) {
+		var res []exemplar.QueryResult
+		warnings, err := s.SelectStream(ctx, 0, 10, hints, func(r exemplar.QueryResult) error {
+			res = append(res, r)
+			return nil
+		}, matchers)
+		return res, warnings, err
+	}
+
+	want, _, err := s.Select(ctx, 0, 10, nil, matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := stream(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("streamed %d series, selected %d", len(got), len(want))
+	}
+
+	got, warnings, err := stream(&model.SelectHints{Limits: model.Limits{MaxExemplars: 300, Truncate: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numExemplars := 0
+	for _, r := range got {
+		numExemplars += len(r.Exemplars)
+	}
+	if numExemplars != 300 || len(warnings) != 1 {
+		t.Fatalf("streamed %d exemplars with warnings %v, want 300 exemplars and a warning", numExemplars, warnings)
+	}
+
+	var limitErr *model.LimitError
+	if _, _, err := stream(&model.SelectHints{Limits: model.Limits{MaxExemplars: 300}}); !errors.As(err, &limitErr) {
+		t.Fatalf("got error %v, want a limit error", err)
+	}
+}
+
+// benchmarkBatch returns n exemplars spread over n/10 series, like a remote
+// write request.
+func benchmarkBatch(n int) []model.SeriesExemplars {
+	series := make([]model.SeriesExemplars, 0, n/10)
+	for i := 0; i < n/10; i++ {
+		ss := model.SeriesExemplars{
+			Labels: labels.FromStrings("__name__", "http_request_duration_seconds_bucket", "le", fmt.Sprint(i%10), "pod", fmt.Sprintf("pod-%d", i/10)),
+		}
+		for j := 0; j < 10; j++ {
+			ss.Exemplars = append(ss.Exemplars, exemplar.Exemplar{
+				Labels: labels.FromStrings("trace_id", fmt.Sprintf("%d-%d", i, j)),
+				Ts:     int64(j + 1),
+				Value:  float64(j),
+				HasTs:  true,
+			})
+		}
+		series = append(series, ss)
+	}
+	return series
+}
+
+func BenchmarkAppendExemplars(b *testing.B) {
+	const batchSize = 2000
+	series := benchmarkBatch(batchSize)
+	ctx := context.Background()
+
+	// Single appends every exemplar on its own, like remote write used to.
+	b.Run("single", func(b *testing.B) {
+		s := newTestStore(b, testOptions(b))
+		defer s.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, ss := range series {
+				for _, e := range ss.Exemplars {
+					if err := s.AppendExemplar(ctx, ss.Labels, e); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		s := newTestStore(b, testOptions(b))
+		defer s.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := s.AppendExemplars(ctx, series); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSelect(b *testing.B) {
+	s := newTestStore(b, testOptions(b))
+	defer s.Close()
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err := s.AppendExemplars(ctx, benchmarkBatch(2000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, bc := range []struct {
+		name     string
+		matchers []*labels.Matcher
+	}{
+		{
+			name:     "equal",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-1")},
+		},
+		{
+			name:     "set regex",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1|pod-2|pod-3")},
+		},
+		{
+			name:     "prefix regex",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")},
+		},
+		{
+			name:     "all series",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+")},
+		},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := s.Select(ctx, 0, 100, nil, bc.matchers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
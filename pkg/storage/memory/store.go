@@ -0,0 +1,260 @@
+// Package memory implements an exemplar store keeping exemplars in a fixed
+// size circular buffer per tenant, the same way Prometheus does. It keeps
+// nothing on disk and is meant for ephemeral setups and as a reference for
+// the semantics of the other stores.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
+)
+
+// Options configures the memory store.
+type Options struct {
+	// MaxExemplars is the number of exemplars kept per tenant. Once the
+	// buffer of a tenant is full, its oldest exemplars are overwritten.
+	MaxExemplars int64
+}
+
+// MemoryStore keeps the exemplars of every tenant in a
+// tsdb.CircularExemplarStorage. Like in Prometheus, exemplars of a series
+// have to be appended in timestamp order: duplicates of the newest exemplar
+// of a series are ignored, older exemplars are rejected.
+type MemoryStore struct {
+	logger log.Logger
+	reg    prometheus.Registerer
+	opts   Options
+
+	mtx     sync.RWMutex
+	tenants map[string]tsdb.ExemplarStorage
+}
+
+// NewMemoryStore creates a memory backed store.
+func NewMemoryStore(logger log.Logger, reg prometheus.Registerer, opts Options) (*MemoryStore, error) {
+	if opts.MaxExemplars <= 0 {
+		return nil, fmt.Errorf("max exemplars must be positive, got %d", opts.MaxExemplars)
+	}
+	s := &MemoryStore{
+		logger:  logger,
+		reg:     reg,
+		opts:    opts,
+		tenants: map[string]tsdb.ExemplarStorage{},
+	}
+	if _, err := s.tenantStorage(tenancy.DefaultTenant, true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close is a no-op, all exemplars are lost once the store is dropped.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// tenantStorage returns the buffer of the given tenant, nil if it has none
+// yet and create is false.
+func (s *MemoryStore) tenantStorage(tenant string, create bool) (tsdb.ExemplarStorage, error) {
+	s.mtx.RLock()
+	es, ok := s.tenants[tenant]
+	s.mtx.RUnlock()
+	if ok || !create {
+		return es, nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if es, ok := s.tenants[tenant]; ok {
+		return es, nil
+	}
+	var reg prometheus.Registerer
+	if s.reg != nil {
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{"tenant": tenant}, s.reg)
+	}
+	es, err := tsdb.NewCircularExemplarStorage(s.opts.MaxExemplars, tsdb.NewExemplarMetrics(reg))
+	if err != nil {
+		return nil, err
+	}
+	s.tenants[tenant] = es
+	return es, nil
+}
+
+func (s *MemoryStore) AppendExemplar(ctx context.Context, lset labels.Labels, e exemplar.Exemplar) error {
+	es, err := s.tenantStorage(tenancy.TenantFromContext(ctx), true)
+	if err != nil {
+		return err
+	}
+	return es.AddExemplar(lset, e)
+}
+
+// AppendExemplars appends the exemplars one by one. Exemplars rejected by
+// the buffer are reported with a model.PartialAppendError, the remaining
+// ones are still appended.
+func (s *MemoryStore) AppendExemplars(ctx context.Context, series []model.SeriesExemplars) error {
+	es, err := s.tenantStorage(tenancy.TenantFromContext(ctx), true)
+	if err != nil {
+		return err
+	}
+	perr := &model.PartialAppendError{}
+	for _, se := range series {
+		for _, e := range se.Exemplars {
+			if err := es.AddExemplar(se.Labels, e); err != nil {
+				perr.Add(err)
+			}
+		}
+	}
+	if perr.NumRejected() > 0 {
+		return perr
+	}
+	return nil
+}
+
+// Select selects the exemplars from the buffer, which is bounded by the
+// maximum number of exemplars already, sorts them and applies the limits of
+// the hints to the results.
+func (s *MemoryStore) Select(ctx context.Context, start, end int64, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, model.Warnings, error) {
+	res, err := s.selectExemplars(ctx, start, end, hints, matchers...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hints.Thinned() {
+		res = model.ThinResults(res, hints.Step, hints.MaxPerStep, hints.Descending)
+	} else {
+		model.SortResults(res, hints.IsDescending())
+	}
+	if hints == nil {
+		return res, nil, nil
+	}
+	return model.LimitResults(res, hints.Limits)
+}
+
+// SelectStream passes the series of Select to fn one by one.
+func (s *MemoryStore) SelectStream(ctx context.Context, start, end int64, hints *model.SelectHints, fn func(exemplar.QueryResult) error, matchers ...[]*labels.Matcher) (model.Warnings, error) {
+	res, warnings, err := s.Select(ctx, start, end, hints, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	return warnings, model.StreamResults(ctx, res, fn)
+}
+
+// selectExemplars selects the exemplars matching the hints, ignoring their
+// step.
+func (s *MemoryStore) selectExemplars(ctx context.Context, start, end int64, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	es, err := s.tenantStorage(tenancy.TenantFromContext(ctx), false)
+	if err != nil {
+		return nil, err
+	}
+	if es == nil {
+		return []exemplar.QueryResult{}, nil
+	}
+	q, err := es.ExemplarQuerier(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := q.Select(start, end, matchers...)
+	if err != nil || hints == nil {
+		return res, err
+	}
+
+	filtered := res[:0]
+	for _, r := range res {
+		exemplars := make([]exemplar.Exemplar, 0, len(r.Exemplars))
+		for _, e := range r.Exemplars {
+			if hints.MatchesValue(e.Value) && hints.MatchesExemplarLabels(e.Labels) {
+				exemplars = append(exemplars, e)
+			}
+		}
+		if len(exemplars) > 0 {
+			r.Exemplars = exemplars
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered, nil
+}
+
+func (s *MemoryStore) SelectTopK(ctx context.Context, start, end int64, k int, perSeries bool, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, error) {
+	res, err := s.selectExemplars(ctx, start, end, hints, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	topK := model.NewTopK(k, perSeries, hints.GetLimits())
+	for _, r := range res {
+		for _, e := range r.Exemplars {
+			if !topK.Add(r.SeriesLabels, e) {
+				return nil, topK.Err()
+			}
+		}
+	}
+	return topK.Results(), nil
+}
+
+func (s *MemoryStore) SelectDensity(ctx context.Context, start, end, step int64, quantiles []float64, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]model.SeriesDensity, error) {
+	res, err := s.selectExemplars(ctx, start, end, hints, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	density := model.NewDensity(step, quantiles, hints.GetLimits())
+	for _, r := range res {
+		for _, e := range r.Exemplars {
+			if !density.Add(r.SeriesLabels, e) {
+				return nil, density.Err()
+			}
+		}
+	}
+	return density.Results(), nil
+}
+
+func (s *MemoryStore) SelectByTraceID(ctx context.Context, start, end int64, traceIDLabel, traceID string, limits model.Limits) ([]exemplar.QueryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	es, err := s.tenantStorage(tenancy.TenantFromContext(ctx), false)
+	if err != nil {
+		return nil, err
+	}
+	res := []exemplar.QueryResult{}
+	if es == nil {
+		return res, nil
+	}
+
+	// The buffer isn't indexed by exemplar labels, so all exemplars have to
+	// be checked. Without warnings, truncated results can't be told from
+	// complete ones.
+	limits.Truncate = false
+	limiter := model.NewLimiter(limits)
+	seriesIdx := map[string]int{}
+	err = es.IterateExemplars(func(lset labels.Labels, e exemplar.Exemplar) error {
+		if e.Ts < start || e.Ts > end || e.Labels.Get(traceIDLabel) != traceID {
+			return nil
+		}
+		if !limiter.Add(lset, e) {
+			return limiter.Err()
+		}
+		key := lset.String()
+		i, ok := seriesIdx[key]
+		if !ok {
+			i = len(res)
+			seriesIdx[key] = i
+			res = append(res, exemplar.QueryResult{SeriesLabels: lset})
+		}
+		res[i].Exemplars = append(res[i].Exemplars, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	model.SortResults(res, false)
+	return res, nil
+}
@@ -0,0 +1,109 @@
+package memory_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	promstorage "github.com/prometheus/prometheus/storage"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/memory"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/storage/storetest"
+)
+
+func newTestStore(t *testing.T, maxExemplars int64) *memory.MemoryStore {
+	s, err := memory.NewMemoryStore(log.NewNopLogger(), prometheus.NewRegistry(), memory.Options{MaxExemplars: maxExemplars})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// selectTimestamps returns the timestamps of the exemplars of series foo.
+func selectTimestamps(t *testing.T, s *memory.MemoryStore) []int64 {
+	t.Helper()
+	res, _, err := s.Select(context.Background(), math.MinInt64, math.MaxInt64, nil, []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "foo")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ts []int64
+	for _, r := range res {
+		for _, e := range r.Exemplars {
+			ts = append(ts, e.Ts)
+		}
+	}
+	return ts
+}
+
+func TestConformance(t *testing.T) {
+	storetest.TestExemplarStore(t, func(t *testing.T) storage.ExemplarStore {
+		return newTestStore(t, 10000)
+	})
+}
+
+// TestAppendOrder checks that exemplars of a series have to be appended in
+// timestamp order, like in Prometheus.
+func TestAppendOrder(t *testing.T) {
+	lset := labels.FromStrings("__name__", "foo")
+	traceID := labels.FromStrings("trace_id", "abc")
+
+	for _, tc := range []struct {
+		name         string
+		ts           []int64
+		wantRejected map[error]int
+		want         []int64
+	}{
+		{name: "in order", ts: []int64{1, 2, 3}, want: []int64{1, 2, 3}},
+		{name: "duplicates ignored", ts: []int64{1, 2, 2}, want: []int64{1, 2}},
+		{name: "out of order rejected", ts: []int64{1, 3, 2}, wantRejected: map[error]int{promstorage.ErrOutOfOrderExemplar: 1}, want: []int64{1, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestStore(t, 10)
+			se := model.SeriesExemplars{Labels: lset}
+			for _, ts := range tc.ts {
+				se.Exemplars = append(se.Exemplars, exemplar.Exemplar{Labels: traceID, Ts: ts, HasTs: true})
+			}
+
+			err := s.AppendExemplars(context.Background(), []model.SeriesExemplars{se})
+			var perr *model.PartialAppendError
+			if tc.wantRejected == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !errors.As(err, &perr) || len(perr.Rejected) != len(tc.wantRejected) {
+				t.Fatalf("got error %v, want %v rejected", err, tc.wantRejected)
+			}
+			for err, n := range tc.wantRejected {
+				if perr.Rejected[err] != n {
+					t.Fatalf("got %d exemplars rejected with %v, want %d", perr.Rejected[err], err, n)
+				}
+			}
+			if got := selectTimestamps(t, s); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got exemplars at %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestMaxExemplars checks that the oldest exemplars are overwritten once the
+// buffer of a tenant is full.
+func TestMaxExemplars(t *testing.T) {
+	s := newTestStore(t, 3)
+	lset := labels.FromStrings("__name__", "foo")
+	for ts := int64(1); ts <= 5; ts++ {
+		if err := s.AppendExemplar(context.Background(), lset, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "abc"), Ts: ts, HasTs: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := selectTimestamps(t, s), []int64{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got exemplars at %v, want %v", got, want)
+	}
+}
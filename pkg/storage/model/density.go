@@ -0,0 +1,218 @@
+package model
+
+import (
+	"math"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// SeriesDensity is the number of exemplars of a series per step.
+type SeriesDensity struct {
+	SeriesLabels labels.Labels   `json:"seriesLabels"`
+	Buckets      []DensityBucket `json:"buckets"`
+}
+
+// DensityBucket holds the exemplars of a series within one step.
+type DensityBucket struct {
+	// Ts is the start of the bucket, a multiple of the step.
+	Ts    int64 `json:"timestamp"`
+	Count int64 `json:"count"`
+	// Quantiles of the exemplar values, empty if no quantiles were requested
+	// or all values of the bucket are NaN.
+	Quantiles []Quantile `json:"quantiles,omitempty"`
+}
+
+// Quantile is the value at quantile Q of the exemplar values of a bucket.
+type Quantile struct {
+	Q     float64 `json:"quantile"`
+	Value float64 `json:"value"`
+}
+
+// BucketStart returns the start of the step bucket of ts. Buckets are
+// aligned to multiples of step.
+func BucketStart(ts, step int64) int64 {
+	b := ts - ts%step
+	if ts < 0 && b != ts {
+		b -= step
+	}
+	return b
+}
+
+// Density counts the exemplars of every series per step bucket and computes
+// quantiles of their values. Values are only kept if quantiles are
+// requested. Every bucket and kept value counts as an exemplar against the
+// limits, of bucketBytes and valueBytes.
+type Density struct {
+	step      int64
+	quantiles []float64
+	limits    Limits
+	index     *SeriesIndex
+	series    []*seriesDensity
+
+	entries int
+	bytes   int64
+	err     *LimitError
+}
+
+const (
+	// bucketBytes is the size of a bucket, its start and count.
+	bucketBytes = 16
+	// valueBytes is the size of a value kept for quantiles.
+	valueBytes = 8
+)
+
+type seriesDensity struct {
+	lset    labels.Labels
+	buckets map[int64]*densityBucket
+}
+
+type densityBucket struct {
+	count  int64
+	values []float64
+}
+
+// NewDensity creates a Density with buckets of step milliseconds computing
+// the given quantiles, each between 0 and 1. The series, buckets and values
+// kept for quantiles are bounded by limits.
+func NewDensity(step int64, quantiles []float64, limits Limits) *Density {
+	return &Density{
+		step:      step,
+		quantiles: quantiles,
+		limits:    limits,
+		index:     NewSeriesIndex(),
+	}
+}
+
+// Add adds an exemplar of the series lset. It returns false once a limit is
+// exceeded, the density must not be added to anymore then.
+func (d *Density) Add(lset labels.Labels, e exemplar.Exemplar) bool {
+	keep := len(d.quantiles) > 0 && !math.IsNaN(e.Value)
+	if keep && !d.account(1, valueBytes) {
+		return false
+	}
+	b := d.bucket(lset, e.Ts)
+	if b == nil {
+		return false
+	}
+	b.count++
+	if keep {
+		b.values = append(b.values, e.Value)
+	}
+	return true
+}
+
+// AddCount adds count exemplars of the series lset to the bucket of ts, for
+// stores counting exemplars themselves. It returns false once a limit is
+// exceeded, like Add.
+func (d *Density) AddCount(lset labels.Labels, ts, count int64) bool {
+	b := d.bucket(lset, ts)
+	if b == nil {
+		return false
+	}
+	b.count += count
+	return true
+}
+
+// Err returns the error of the select if a limit was reached. Truncated
+// buckets would have wrong counts and quantiles, so reaching a limit always
+// fails the select.
+func (d *Density) Err() error {
+	if d.err == nil {
+		return nil
+	}
+	return d.err
+}
+
+// account accounts entries of the given size against the limits, returning
+// false if they exceed one.
+func (d *Density) account(entries int, bytes int64) bool {
+	if d.err != nil {
+		return false
+	}
+	switch {
+	case d.limits.MaxExemplars > 0 && d.entries+entries > d.limits.MaxExemplars:
+		d.err = &LimitError{Limit: "exemplars", Max: int64(d.limits.MaxExemplars)}
+	case d.limits.MaxBytes > 0 && d.bytes+bytes > d.limits.MaxBytes:
+		d.err = &LimitError{Limit: "bytes", Max: d.limits.MaxBytes}
+	}
+	if d.err != nil {
+		return false
+	}
+	d.entries += entries
+	d.bytes += bytes
+	return true
+}
+
+// bucket returns the bucket of ts of the series lset, nil if adding it
+// exceeds a limit.
+func (d *Density) bucket(lset labels.Labels, ts int64) *densityBucket {
+	if d.err != nil {
+		return nil
+	}
+	i, ok := d.index.Get(lset)
+	if !ok {
+		if d.limits.MaxSeries > 0 && d.index.Len() >= d.limits.MaxSeries {
+			d.err = &LimitError{Limit: "series", Max: int64(d.limits.MaxSeries)}
+			return nil
+		}
+		if !d.account(0, labelsBytes(lset)) {
+			return nil
+		}
+		i, _ = d.index.Add(lset)
+		d.series = append(d.series, &seriesDensity{lset: lset, buckets: map[int64]*densityBucket{}})
+	}
+	s := d.series[i]
+	start := BucketStart(ts, d.step)
+	b, ok := s.buckets[start]
+	if !ok {
+		if !d.account(1, bucketBytes) {
+			return nil
+		}
+		b = &densityBucket{}
+		s.buckets[start] = b
+	}
+	return b
+}
+
+// Results returns the buckets of every series, sorted by time. Series are
+// sorted by their labels.
+func (d *Density) Results() []SeriesDensity {
+	res := make([]SeriesDensity, 0, len(d.series))
+	for _, s := range d.series {
+		sd := SeriesDensity{
+			SeriesLabels: s.lset,
+			Buckets:      make([]DensityBucket, 0, len(s.buckets)),
+		}
+		for ts, b := range s.buckets {
+			db := DensityBucket{Ts: ts, Count: b.count}
+			if len(b.values) > 0 {
+				sort.Float64s(b.values)
+				for _, q := range d.quantiles {
+					db.Quantiles = append(db.Quantiles, Quantile{Q: q, Value: quantile(q, b.values)})
+				}
+			}
+			sd.Buckets = append(sd.Buckets, db)
+		}
+		sort.Slice(sd.Buckets, func(i, j int) bool {
+			return sd.Buckets[i].Ts < sd.Buckets[j].Ts
+		})
+		res = append(res, sd)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return labels.Compare(res[i].SeriesLabels, res[j].SeriesLabels) < 0
+	})
+	return res
+}
+
+// quantile returns the q-quantile of the sorted values, interpolating
+// linearly between the closest ranks like PromQL's quantile_over_time.
+func quantile(q float64, values []float64) float64 {
+	n := float64(len(values))
+	rank := q * (n - 1)
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(n-1, lower+1)
+	weight := rank - math.Floor(rank)
+	return values[int(lower)]*(1-weight) + values[int(upper)]*weight
+}
@@ -0,0 +1,147 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Warnings are problems of a select that didn't fail it, like truncated
+// results.
+type Warnings []error
+
+// Limits bounds the results of a single select. A limit of 0 is unlimited.
+type Limits struct {
+	MaxSeries    int
+	MaxExemplars int
+	// MaxBytes limits the estimated size of the selected series and
+	// exemplars, see ExemplarBytes.
+	MaxBytes int64
+	// Truncate returns the exemplars selected until a limit is reached with
+	// a warning instead of failing the select.
+	Truncate bool
+}
+
+// LimitError is returned by selects exceeding one of their limits.
+type LimitError struct {
+	// Limit is what was limited, series, exemplars or bytes.
+	Limit string
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("query exceeded the maximum number of %s (%d)", e.Limit, e.Max)
+}
+
+// ExemplarBytes estimates the size of an exemplar in memory, the size of its
+// labels and of its timestamp and value.
+func ExemplarBytes(e exemplar.Exemplar) int64 {
+	return labelsBytes(e.Labels) + 16
+}
+
+func labelsBytes(lset labels.Labels) int64 {
+	n := 0
+	for _, l := range lset {
+		n += len(l.Name) + len(l.Value)
+	}
+	return int64(n)
+}
+
+// Limiter accounts the exemplars collected by a select against its limits.
+// Once a limit is reached, all further exemplars are rejected.
+type Limiter struct {
+	limits Limits
+
+	series    *SeriesIndex
+	exemplars int
+	bytes     int64
+	err       *LimitError
+}
+
+// NewLimiter creates a Limiter enforcing limits.
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits: limits,
+		series: NewSeriesIndex(),
+	}
+}
+
+// Add accounts an exemplar of the series lset. It returns false if the
+// exemplar exceeds a limit and must be dropped.
+func (l *Limiter) Add(lset labels.Labels, e exemplar.Exemplar) bool {
+	if l.err != nil {
+		return false
+	}
+	_, seen := l.series.Get(lset)
+	bytes := ExemplarBytes(e)
+	if !seen {
+		bytes += labelsBytes(lset)
+	}
+
+	switch {
+	case !seen && l.limits.MaxSeries > 0 && l.series.Len() >= l.limits.MaxSeries:
+		l.err = &LimitError{Limit: "series", Max: int64(l.limits.MaxSeries)}
+	case l.limits.MaxExemplars > 0 && l.exemplars >= l.limits.MaxExemplars:
+		l.err = &LimitError{Limit: "exemplars", Max: int64(l.limits.MaxExemplars)}
+	case l.limits.MaxBytes > 0 && l.bytes+bytes > l.limits.MaxBytes:
+		l.err = &LimitError{Limit: "bytes", Max: l.limits.MaxBytes}
+	}
+	if l.err != nil {
+		return false
+	}
+
+	l.series.Add(lset)
+	l.exemplars++
+	l.bytes += bytes
+	return true
+}
+
+// Err returns the error of the select if a limit was reached and the limits
+// don't allow truncation.
+func (l *Limiter) Err() error {
+	if l.err == nil || l.limits.Truncate {
+		return nil
+	}
+	return l.err
+}
+
+// Warnings returns the warnings of the select, a truncation warning if a
+// limit was reached and the limits allow truncation.
+func (l *Limiter) Warnings() Warnings {
+	if l.err == nil || !l.limits.Truncate {
+		return nil
+	}
+	return Warnings{fmt.Errorf("results truncated: %w", l.err)}
+}
+
+// Reached returns whether a limit was reached.
+func (l *Limiter) Reached() bool {
+	return l.err != nil
+}
+
+// LimitResults applies limits to already selected exemplars. Series are
+// kept in order, exemplars exceeding a limit dropped.
+func LimitResults(res []exemplar.QueryResult, limits Limits) ([]exemplar.QueryResult, Warnings, error) {
+	l := NewLimiter(limits)
+	limited := make([]exemplar.QueryResult, 0, len(res))
+	for _, r := range res {
+		exemplars := make([]exemplar.Exemplar, 0, len(r.Exemplars))
+		for _, e := range r.Exemplars {
+			if !l.Add(r.SeriesLabels, e) {
+				break
+			}
+			exemplars = append(exemplars, e)
+		}
+		if len(exemplars) > 0 {
+			limited = append(limited, exemplar.QueryResult{SeriesLabels: r.SeriesLabels, Exemplars: exemplars})
+		}
+		if l.Reached() {
+			break
+		}
+	}
+	if err := l.Err(); err != nil {
+		return nil, nil, err
+	}
+	return limited, l.Warnings(), nil
+}
@@ -0,0 +1,147 @@
+// Package model contains the types shared between the storage interfaces and
+// the storage backends implementing them.
+package model
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// SeriesExemplars holds a batch of exemplars belonging to the same series.
+type SeriesExemplars struct {
+	Labels    labels.Labels
+	Exemplars []exemplar.Exemplar
+}
+
+// PartialAppendError is returned by AppendExemplars if the store rejected
+// some of the exemplars of a batch, all others were appended.
+type PartialAppendError struct {
+	// Rejected counts the rejected exemplars by error.
+	Rejected map[error]int
+}
+
+// Add records a rejected exemplar.
+func (e *PartialAppendError) Add(err error) {
+	if e.Rejected == nil {
+		e.Rejected = map[error]int{}
+	}
+	e.Rejected[err]++
+}
+
+// NumRejected returns the number of rejected exemplars.
+func (e *PartialAppendError) NumRejected() int {
+	n := 0
+	for _, c := range e.Rejected {
+		n += c
+	}
+	return n
+}
+
+func (e *PartialAppendError) Error() string {
+	return fmt.Sprintf("rejected %d exemplars", e.NumRejected())
+}
+
+// ExecutionError is returned by selects whose query failed while executing.
+// Failures caused by the context of the select unwrap to its error.
+type ExecutionError struct {
+	Err error
+}
+
+func (e *ExecutionError) Error() string {
+	return "execute query: " + e.Err.Error()
+}
+
+func (e *ExecutionError) Unwrap() error {
+	return e.Err
+}
+
+// SelectHints holds the optional parameters of a select. A nil *SelectHints
+// selects all exemplars of the matched series.
+type SelectHints struct {
+	// ExemplarMatchers filters the exemplars of the selected series by
+	// their exemplar labels. An exemplar is kept if it matches all matchers
+	// of any of the matcher sets, series left without exemplars are dropped.
+	ExemplarMatchers [][]*labels.Matcher
+	// MinValue and MaxValue limit the values of the selected exemplars,
+	// both inclusive. Unbounded if nil.
+	MinValue, MaxValue *float64
+	// Step thins the exemplars of Select to at most MaxPerStep exemplars
+	// per series and window of Step milliseconds, preferring the highest
+	// values. Windows are aligned to multiples of Step, no thinning if 0.
+	Step       int64
+	MaxPerStep int
+	// Limits bounds the results of Select.
+	Limits Limits
+	// Descending sorts the exemplars of every series returned by Select by
+	// timestamp in descending order instead of ascending.
+	Descending bool
+}
+
+// MatchesExemplarLabels returns whether exemplar labels lset match the
+// exemplar matchers of the hints.
+func (h *SelectHints) MatchesExemplarLabels(lset labels.Labels) bool {
+	if h == nil || len(h.ExemplarMatchers) == 0 {
+		return true
+	}
+	for _, ms := range h.ExemplarMatchers {
+		if Matches(lset, ms) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns whether lset matches all matchers. Like in Prometheus,
+// a label lset doesn't have matches like a label with an empty value.
+func Matches(lset labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchesValue returns whether v is within the value range of the hints.
+func (h *SelectHints) MatchesValue(v float64) bool {
+	if h == nil {
+		return true
+	}
+	if h.MinValue != nil && !(v >= *h.MinValue) {
+		return false
+	}
+	if h.MaxValue != nil && !(v <= *h.MaxValue) {
+		return false
+	}
+	return true
+}
+
+// HasValueRange returns whether the hints limit the exemplar values.
+func (h *SelectHints) HasValueRange() bool {
+	return h != nil && (h.MinValue != nil || h.MaxValue != nil)
+}
+
+// Thinned returns whether the hints thin the selected exemplars by step.
+func (h *SelectHints) Thinned() bool {
+	return h != nil && h.Step > 0 && h.MaxPerStep > 0
+}
+
+// IsDescending returns whether the hints sort exemplars in descending order.
+func (h *SelectHints) IsDescending() bool {
+	return h != nil && h.Descending
+}
+
+// NewLimiter returns a Limiter enforcing the limits of the hints.
+func (h *SelectHints) NewLimiter() *Limiter {
+	return NewLimiter(h.GetLimits())
+}
+
+// GetLimits returns the limits of the hints, no limits if the hints are nil.
+func (h *SelectHints) GetLimits() Limits {
+	if h == nil {
+		return Limits{}
+	}
+	return h.Limits
+}
@@ -0,0 +1,86 @@
+package model
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// SeriesIndex numbers series in the order they are added. Series are looked
+// up by the hash of their labels, and label sets are compared so series
+// with colliding hashes are kept apart.
+type SeriesIndex struct {
+	hashes map[uint64][]int
+	series []labels.Labels
+}
+
+// NewSeriesIndex creates an empty SeriesIndex.
+func NewSeriesIndex() *SeriesIndex {
+	return &SeriesIndex{hashes: map[uint64][]int{}}
+}
+
+// Get returns the index of the series lset, false if it wasn't added.
+func (s *SeriesIndex) Get(lset labels.Labels) (int, bool) {
+	for _, i := range s.hashes[lset.Hash()] {
+		if labels.Equal(s.series[i], lset) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Add returns the index of the series lset, adding it if needed. added
+// reports whether the series is new.
+func (s *SeriesIndex) Add(lset labels.Labels) (i int, added bool) {
+	hash := lset.Hash()
+	for _, i := range s.hashes[hash] {
+		if labels.Equal(s.series[i], lset) {
+			return i, false
+		}
+	}
+	i = len(s.series)
+	s.hashes[hash] = append(s.hashes[hash], i)
+	s.series = append(s.series, lset)
+	return i, true
+}
+
+// Len returns the number of series.
+func (s *SeriesIndex) Len() int {
+	return len(s.series)
+}
+
+// SortResults sorts series by their labels and the exemplars of every
+// series by timestamp, in descending order if descending is true.
+func SortResults(res []exemplar.QueryResult, descending bool) {
+	sort.Slice(res, func(i, j int) bool {
+		return labels.Compare(res[i].SeriesLabels, res[j].SeriesLabels) < 0
+	})
+	for _, r := range res {
+		exemplars := r.Exemplars
+		sort.SliceStable(exemplars, func(i, j int) bool {
+			if descending {
+				return exemplars[i].Ts > exemplars[j].Ts
+			}
+			return exemplars[i].Ts < exemplars[j].Ts
+		})
+	}
+}
+
+// StreamResults calls fn with every series of res in order, dropping the
+// references to the series already passed so they can be freed. It stops
+// on the first error of fn or once ctx is done.
+func StreamResults(ctx context.Context, res []exemplar.QueryResult, fn func(exemplar.QueryResult) error) error {
+	for i := range res {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r := res[i]
+		res[i] = exemplar.QueryResult{}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
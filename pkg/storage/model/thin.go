@@ -0,0 +1,102 @@
+package model
+
+import (
+	"container/heap"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// StepThinner keeps at most n exemplars per series and step window,
+// preferring the exemplars with the highest values. Only n exemplars per
+// window are kept in memory, so stores can feed it all exemplars of a scan.
+// The kept series and exemplars are accounted against a Limiter.
+type StepThinner struct {
+	step    int64
+	n       int
+	limiter *Limiter
+
+	index   *SeriesIndex
+	windows map[stepWindow]*exemplarHeap
+}
+
+type stepWindow struct {
+	series int
+	start  int64
+}
+
+// NewStepThinner creates a StepThinner for windows of step milliseconds
+// aligned to multiples of step, accounting the kept exemplars against
+// limiter.
+func NewStepThinner(step int64, n int, limiter *Limiter) *StepThinner {
+	return &StepThinner{
+		step:    step,
+		n:       n,
+		limiter: limiter,
+		index:   NewSeriesIndex(),
+		windows: map[stepWindow]*exemplarHeap{},
+	}
+}
+
+// Add adds an exemplar of the series lset. It returns false once the kept
+// exemplars exceed a limit of the limiter, the StepThinner must not be
+// added to anymore then. Exemplars replacing a kept one aren't accounted
+// again.
+func (t *StepThinner) Add(lset labels.Labels, e exemplar.Exemplar) bool {
+	if t.limiter.Reached() {
+		return false
+	}
+	if t.n <= 0 {
+		return true
+	}
+	start := BucketStart(e.Ts, t.step)
+	i, ok := t.index.Get(lset)
+	var h *exemplarHeap
+	if ok {
+		h = t.windows[stepWindow{series: i, start: start}]
+	}
+
+	if h == nil || h.Len() < t.n {
+		if !t.limiter.Add(lset, e) {
+			return false
+		}
+		if h == nil {
+			i, _ = t.index.Add(lset)
+			h = &exemplarHeap{}
+			t.windows[stepWindow{series: i, start: start}] = h
+		}
+		heap.Push(h, seriesExemplar{lset: lset, e: e})
+		return true
+	}
+	if lessValue((*h)[0].e.Value, e.Value) {
+		(*h)[0] = seriesExemplar{lset: lset, e: e}
+		heap.Fix(h, 0)
+	}
+	return true
+}
+
+// Results returns the kept exemplars grouped by series, sorted like
+// SortResults.
+func (t *StepThinner) Results(descending bool) []exemplar.QueryResult {
+	res := make([]exemplar.QueryResult, t.index.Len())
+	for w, h := range t.windows {
+		res[w.series].SeriesLabels = (*h)[0].lset
+		for _, se := range *h {
+			res[w.series].Exemplars = append(res[w.series].Exemplars, se.e)
+		}
+	}
+	SortResults(res, descending)
+	return res
+}
+
+// ThinResults thins already selected exemplars like a StepThinner, without
+// limits.
+func ThinResults(res []exemplar.QueryResult, step int64, n int, descending bool) []exemplar.QueryResult {
+	t := NewStepThinner(step, n, NewLimiter(Limits{}))
+	for _, r := range res {
+		for _, e := range r.Exemplars {
+			t.Add(r.SeriesLabels, e)
+		}
+	}
+	return t.Results(descending)
+}
@@ -0,0 +1,161 @@
+package model
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// TopK collects the k exemplars with the highest values, either across all
+// series or per series. Only k exemplars per heap are kept in memory, so
+// stores can feed it all exemplars of a scan. Exemplars with NaN values are
+// ignored. The kept series and exemplars are bounded by limits.
+type TopK struct {
+	k         int
+	perSeries bool
+	limits    Limits
+
+	global *exemplarHeap
+	index  *SeriesIndex
+	series []*exemplarHeap
+
+	exemplars int
+	bytes     int64
+	err       *LimitError
+}
+
+// NewTopK creates a TopK keeping k exemplars in total, or per series if
+// perSeries is true.
+func NewTopK(k int, perSeries bool, limits Limits) *TopK {
+	return &TopK{
+		k:         k,
+		perSeries: perSeries,
+		limits:    limits,
+		global:    &exemplarHeap{},
+		index:     NewSeriesIndex(),
+	}
+}
+
+// Add adds an exemplar of the series lset. It returns false once the kept
+// exemplars exceed a limit, the TopK must not be added to anymore then.
+func (t *TopK) Add(lset labels.Labels, e exemplar.Exemplar) bool {
+	if t.err != nil {
+		return false
+	}
+	if t.k <= 0 || math.IsNaN(e.Value) {
+		return true
+	}
+	h := t.global
+	if t.perSeries {
+		i, ok := t.index.Get(lset)
+		if !ok {
+			if t.limits.MaxSeries > 0 && t.index.Len() >= t.limits.MaxSeries {
+				t.err = &LimitError{Limit: "series", Max: int64(t.limits.MaxSeries)}
+				return false
+			}
+			i, _ = t.index.Add(lset)
+			t.series = append(t.series, &exemplarHeap{})
+		}
+		h = t.series[i]
+	}
+
+	// Kept exemplars are estimated with the labels of their series.
+	bytes := ExemplarBytes(e) + labelsBytes(lset)
+	if h.Len() < t.k {
+		switch {
+		case t.limits.MaxExemplars > 0 && t.exemplars >= t.limits.MaxExemplars:
+			t.err = &LimitError{Limit: "exemplars", Max: int64(t.limits.MaxExemplars)}
+		case t.limits.MaxBytes > 0 && t.bytes+bytes > t.limits.MaxBytes:
+			t.err = &LimitError{Limit: "bytes", Max: t.limits.MaxBytes}
+		}
+		if t.err != nil {
+			return false
+		}
+		heap.Push(h, seriesExemplar{lset: lset, e: e})
+		t.exemplars++
+		t.bytes += bytes
+		return true
+	}
+	if e.Value > (*h)[0].e.Value {
+		replaced := (*h)[0]
+		delta := bytes - ExemplarBytes(replaced.e) - labelsBytes(replaced.lset)
+		if t.limits.MaxBytes > 0 && t.bytes+delta > t.limits.MaxBytes {
+			t.err = &LimitError{Limit: "bytes", Max: t.limits.MaxBytes}
+			return false
+		}
+		(*h)[0] = seriesExemplar{lset: lset, e: e}
+		heap.Fix(h, 0)
+		t.bytes += delta
+	}
+	return true
+}
+
+// Err returns the error of the select if a limit was reached. The top
+// exemplars of a truncated scan would be wrong, so reaching a limit always
+// fails the select.
+func (t *TopK) Err() error {
+	if t.err == nil {
+		return nil
+	}
+	return t.err
+}
+
+// Results returns the collected exemplars grouped by series. Exemplars are
+// sorted by value in descending order, series by their highest value.
+func (t *TopK) Results() []exemplar.QueryResult {
+	heaps := []*exemplarHeap{t.global}
+	if t.perSeries {
+		heaps = t.series
+	}
+
+	var all []seriesExemplar
+	for _, h := range heaps {
+		all = append(all, *h...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].e.Value > all[j].e.Value
+	})
+
+	res := []exemplar.QueryResult{}
+	idx := NewSeriesIndex()
+	for _, se := range all {
+		i, added := idx.Add(se.lset)
+		if added {
+			res = append(res, exemplar.QueryResult{SeriesLabels: se.lset})
+		}
+		res[i].Exemplars = append(res[i].Exemplars, se.e)
+	}
+	return res
+}
+
+type seriesExemplar struct {
+	lset labels.Labels
+	e    exemplar.Exemplar
+}
+
+// exemplarHeap is a min-heap of exemplars by value.
+type exemplarHeap []seriesExemplar
+
+func (h exemplarHeap) Len() int           { return len(h) }
+func (h exemplarHeap) Less(i, j int) bool { return lessValue(h[i].e.Value, h[j].e.Value) }
+func (h exemplarHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *exemplarHeap) Push(x interface{}) {
+	*h = append(*h, x.(seriesExemplar))
+}
+
+func (h *exemplarHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// lessValue orders exemplar values ascending, with NaN lower than all other
+// values.
+func lessValue(a, b float64) bool {
+	return a < b || (math.IsNaN(a) && !math.IsNaN(b))
+}
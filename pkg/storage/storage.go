@@ -4,31 +4,85 @@ import (
 	"context"
 
 	"github.com/go-kit/log"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/model/exemplar"
 	"github.com/prometheus/prometheus/model/labels"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/yeya24/exemplars-storage/pkg/storage/frostdb"
+	"github.com/yeya24/exemplars-storage/pkg/storage/memory"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
 )
 
 type ExemplarStoreType string
 
 const (
 	FrostDBExemplarStore ExemplarStoreType = "frostdb"
+	// MemoryExemplarStore keeps a fixed number of exemplars per tenant in
+	// memory, with the semantics of the Prometheus exemplar storage.
+	MemoryExemplarStore ExemplarStoreType = "memory"
 )
 
 type ExemplarStore interface {
 	ExemplarAppender
 	ExemplarQuerier
+	// Close releases all resources of the store.
+	Close() error
 }
 
 type ExemplarAppender interface {
 	AppendExemplar(ctx context.Context, lset labels.Labels, e exemplar.Exemplar) error
+	// AppendExemplars appends the exemplars of multiple series at once.
+	// If the store rejects only some of the exemplars, it returns a
+	// *model.PartialAppendError and appends the others.
+	AppendExemplars(ctx context.Context, series []model.SeriesExemplars) error
 }
 
+// ExemplarQuerier selects exemplars. Selects fail with the error of their
+// context once it is canceled or its deadline is exceeded, and with a
+// *model.ExecutionError if the query fails in the store.
 type ExemplarQuerier interface {
-	Select(ctx context.Context, start, end int64, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, error)
+	// Select returns the exemplars between start and end of all series
+	// matching any of the matcher sets, grouped by series. Series are sorted
+	// by labels, exemplars by timestamp in the order of the hints, which
+	// may be nil.
+	// If the select exceeds the limits of the hints, it fails with a
+	// *model.LimitError, or returns the exemplars selected until then with
+	// a warning if the limits allow truncation.
+	Select(ctx context.Context, start, end int64, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, model.Warnings, error)
+	// SelectStream selects like Select, but calls fn with every series in
+	// the order of Select instead of returning them all at once. It stops
+	// and returns the error of fn if fn fails. Stores may buffer the whole
+	// result before calling fn, streaming doesn't bound their memory.
+	SelectStream(ctx context.Context, start, end int64, hints *model.SelectHints, fn func(exemplar.QueryResult) error, matchers ...[]*labels.Matcher) (model.Warnings, error)
+	// SelectTopK returns the k exemplars with the highest values between
+	// start and end of all series matching any of the matcher sets, or the
+	// k highest of every series if perSeries is true. Exemplars are sorted
+	// by value in descending order, series by their highest value. If the
+	// kept exemplars exceed the limits of the hints, it fails with a
+	// *model.LimitError, also if the limits allow truncation.
+	SelectTopK(ctx context.Context, start, end int64, k int, perSeries bool, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]exemplar.QueryResult, error)
+	// SelectDensity counts the exemplars between start and end of all
+	// series matching any of the matcher sets per bucket of step
+	// milliseconds, and computes the given quantiles of their values.
+	// Buckets are aligned to multiples of step and sorted by time. Every
+	// bucket and value kept for quantiles counts as an exemplar against the
+	// limits of the hints, exceeding them fails with a *model.LimitError.
+	SelectDensity(ctx context.Context, start, end, step int64, quantiles []float64, hints *model.SelectHints, matchers ...[]*labels.Matcher) ([]model.SeriesDensity, error)
+	// SelectByTraceID returns the exemplars between start and end whose
+	// exemplar label traceIDLabel is traceID, grouped by series and sorted
+	// like Select. Exceeding limits fails with a *model.LimitError, also if
+	// they allow truncation.
+	SelectByTraceID(ctx context.Context, start, end int64, traceIDLabel, traceID string, limits model.Limits) ([]exemplar.QueryResult, error)
+}
+
+// Options configures the exemplar stores.
+type Options struct {
+	// FrostDB configures the FrostDBExemplarStore.
+	FrostDB frostdb.Options
+	// Memory configures the MemoryExemplarStore.
+	Memory memory.Options
 }
 
 func NewExemplarStore(
@@ -36,10 +90,13 @@ func NewExemplarStore(
 	tracer trace.Tracer,
 	reg prometheus.Registerer,
 	storeType ExemplarStoreType,
+	opts Options,
 ) (ExemplarStore, error) {
 	switch storeType {
 	case FrostDBExemplarStore:
-		return frostdb.NewFrostDBStore(logger, tracer, reg, "exemplars")
+		return frostdb.NewFrostDBStore(logger, tracer, reg, "exemplars", opts.FrostDB)
+	case MemoryExemplarStore:
+		return memory.NewMemoryStore(logger, reg, opts.Memory)
 	}
-	return nil, nil
+	return nil, errors.Errorf("unknown exemplar store type %q", storeType)
 }
@@ -0,0 +1,1013 @@
+// Package storetest contains a conformance test suite for implementations of
+// storage.ExemplarStore. Backends run it from their own tests:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.TestExemplarStore(t, func(t *testing.T) storage.ExemplarStore {
+//			...
+//		})
+//	}
+//
+// The expected semantics are those of the Prometheus exemplar storage:
+// time bounds are inclusive, series are matched if they match any of the
+// selectors and results are grouped by series. Exemplars are appended in
+// timestamp order per series, so stores rejecting out of order exemplars
+// pass as well. Select sorts series by labels and exemplars by timestamp,
+// the order of the other results is only checked where it is documented.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/model"
+	"github.com/yeya24/exemplars-storage/pkg/tenancy"
+)
+
+// NewStoreFunc creates an empty store for a single test. The store must be
+// able to keep at least 10000 exemplars per tenant, it is closed at the end
+// of the test.
+type NewStoreFunc func(t *testing.T) storage.ExemplarStore
+
+// TestExemplarStore runs all conformance tests as subtests of t, each with a
+// new store.
+func TestExemplarStore(t *testing.T, newStore NewStoreFunc) {
+	for _, tc := range []struct {
+		name string
+		test func(*testing.T, storage.ExemplarStore)
+	}{
+		{name: "Select", test: testSelect},
+		{name: "AppendSingle", test: testAppendSingle},
+		{name: "TimeBounds", test: testTimeBounds},
+		{name: "MatcherSemantics", test: testMatcherSemantics},
+		{name: "Limits", test: testLimits},
+		{name: "SelectStream", test: testSelectStream},
+		{name: "SelectTopK", test: testSelectTopK},
+		{name: "SelectDensity", test: testSelectDensity},
+		{name: "SelectByTraceID", test: testSelectByTraceID},
+		{name: "Tenants", test: testTenants},
+		{name: "Cancellation", test: testCancellation},
+		{name: "Concurrency", test: testConcurrency},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, open(t, newStore))
+		})
+	}
+}
+
+// testSelect checks the series and exemplars Select returns for the
+// matchers, and the exemplar matchers, value range, thinning and order of
+// the select hints. Series must be sorted by labels and exemplars by
+// timestamp regardless of the order they were appended in, so the test data
+// is appended in reverse, series by series.
+func testSelect(t *testing.T, s storage.ExemplarStore) {
+	ctx := context.Background()
+	data := testData()
+	for i := len(data) - 1; i >= 0; i-- {
+		appendAll(ctx, t, s, pick(data, i))
+	}
+
+	value := func(v float64) *float64 { return &v }
+	keep := func(se model.SeriesExemplars, idx ...int) model.SeriesExemplars {
+		res := model.SeriesExemplars{Labels: se.Labels}
+		for _, i := range idx {
+			res.Exemplars = append(res.Exemplars, se.Exemplars[i])
+		}
+		return res
+	}
+	// spans returns the second exemplar of the series, the one with a
+	// span_id label.
+	spans := func(idx ...int) []model.SeriesExemplars {
+		res := make([]model.SeriesExemplars, 0, len(idx))
+		for _, i := range idx {
+			res = append(res, keep(data[i], 1))
+		}
+		return res
+	}
+	all := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+")}
+	api := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "api")}
+	worker := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "worker")}
+	for _, tc := range []struct {
+		name     string
+		hints    *model.SelectHints
+		matchers [][]*labels.Matcher
+		want     []model.SeriesExemplars
+	}{
+		{name: "all", matchers: [][]*labels.Matcher{all}, want: data},
+		{name: "empty hints", hints: &model.SelectHints{}, matchers: [][]*labels.Matcher{all}, want: data},
+		{name: "no match", matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "not_existing")}}},
+
+		// All matcher types against labels present on the series.
+		{
+			name:     "equal",
+			matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "http_request_duration_seconds_bucket")}},
+			want:     pick(data, 0, 1, 2),
+		},
+		{
+			name: "not equal",
+			matchers: [][]*labels.Matcher{{
+				labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "http_request_duration_seconds_bucket"),
+				labels.MustNewMatcher(labels.MatchNotEqual, "le", "0.5"),
+			}},
+			want: pick(data, 1, 2),
+		},
+		{name: "regexp alternation", matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchRegexp, "le", "0.5|1")}}, want: pick(data, 0, 1)},
+		{name: "regexp prefix", matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, "rpc_.*")}}, want: pick(data, 3, 4)},
+		{
+			name: "not regexp",
+			matchers: [][]*labels.Matcher{{
+				labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+"),
+				labels.MustNewMatcher(labels.MatchNotRegexp, "job", "api|rpc"),
+			}},
+			want: pick(data, 4),
+		},
+		{
+			name: "multiple matchers",
+			matchers: [][]*labels.Matcher{{
+				labels.MustNewMatcher(labels.MatchEqual, "job", "rpc"),
+				labels.MustNewMatcher(labels.MatchEqual, "instance", "b"),
+			}},
+			want: pick(data, 3),
+		},
+
+		// Series matching any of the selectors are returned once.
+		{
+			name: "union",
+			matchers: [][]*labels.Matcher{
+				{labels.MustNewMatcher(labels.MatchEqual, "le", "0.5")},
+				{labels.MustNewMatcher(labels.MatchEqual, "job", "rpc")},
+			},
+			want: pick(data, 0, 3),
+		},
+		{
+			name: "overlapping selectors",
+			matchers: [][]*labels.Matcher{
+				{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "http_request_duration_seconds_bucket")},
+				{labels.MustNewMatcher(labels.MatchEqual, "le", "1")},
+				{labels.MustNewMatcher(labels.MatchEqual, "le", "+Inf")},
+			},
+			want: pick(data, 0, 1, 2),
+		},
+		{name: "selectors out of order", matchers: [][]*labels.Matcher{worker, api}, want: pick(data, 0, 1, 2, 4)},
+
+		// Exemplar matchers filter the exemplars, series left without
+		// exemplars are dropped.
+		{
+			name:     "exemplar equal",
+			hints:    &model.SelectHints{ExemplarMatchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "span_id", fmt.Sprintf("%016x", 1))}}},
+			matchers: [][]*labels.Matcher{api},
+			want:     spans(0, 1, 2),
+		},
+		{
+			name:     "exemplar regexp",
+			hints:    &model.SelectHints{ExemplarMatchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchRegexp, "trace_id", fmt.Sprintf("%032x|%032x", 11, 21))}}},
+			matchers: [][]*labels.Matcher{api},
+			want:     spans(1, 2),
+		},
+		{
+			name: "exemplar matcher sets",
+			hints: &model.SelectHints{ExemplarMatchers: [][]*labels.Matcher{
+				{labels.MustNewMatcher(labels.MatchEqual, "trace_id", fmt.Sprintf("%032x", 1))},
+				{labels.MustNewMatcher(labels.MatchEqual, "trace_id", fmt.Sprintf("%032x", 21))},
+			}},
+			matchers: [][]*labels.Matcher{api},
+			want:     spans(0, 2),
+		},
+		{
+			name:     "exemplar no match",
+			hints:    &model.SelectHints{ExemplarMatchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "trace_id", "not_existing")}}},
+			matchers: [][]*labels.Matcher{api},
+		},
+		{
+			name:     "exemplar unknown label",
+			hints:    &model.SelectHints{ExemplarMatchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "not_existing", "value")}}},
+			matchers: [][]*labels.Matcher{api},
+		},
+
+		// Value ranges are inclusive.
+		{name: "min value", hints: &model.SelectHints{MinValue: value(3.2)}, matchers: [][]*labels.Matcher{all}, want: []model.SeriesExemplars{
+			keep(data[3], 2), data[4],
+		}},
+		{name: "max value", hints: &model.SelectHints{MaxValue: value(0.1)}, matchers: [][]*labels.Matcher{all}, want: []model.SeriesExemplars{
+			keep(data[0], 0, 1),
+		}},
+		{name: "min and max value", hints: &model.SelectHints{MinValue: value(1.1), MaxValue: value(2)}, matchers: [][]*labels.Matcher{all}, want: []model.SeriesExemplars{
+			keep(data[1], 1, 2), keep(data[2], 0),
+		}},
+		{name: "equal values", hints: &model.SelectHints{MinValue: value(4.1), MaxValue: value(4.1)}, matchers: [][]*labels.Matcher{all}, want: []model.SeriesExemplars{
+			keep(data[4], 1),
+		}},
+		{name: "empty value range", hints: &model.SelectHints{MinValue: value(10)}, matchers: [][]*labels.Matcher{all}},
+
+		// Thinning keeps the highest values per window. With a step of 20,
+		// the first two exemplars of every series fall into the window at
+		// 100, the third one into the window at 120.
+		{name: "one per step", hints: &model.SelectHints{Step: 20, MaxPerStep: 1}, matchers: [][]*labels.Matcher{api}, want: []model.SeriesExemplars{
+			keep(data[0], 1, 2), keep(data[1], 1, 2), keep(data[2], 1, 2),
+		}},
+		{name: "all fit in steps", hints: &model.SelectHints{Step: 20, MaxPerStep: 2}, matchers: [][]*labels.Matcher{api}, want: pick(data, 0, 1, 2)},
+		{name: "single step", hints: &model.SelectHints{Step: 1000, MaxPerStep: 2}, matchers: [][]*labels.Matcher{api}, want: []model.SeriesExemplars{
+			keep(data[0], 1, 2), keep(data[1], 1, 2), keep(data[2], 1, 2),
+		}},
+		{
+			name:     "thinned value range",
+			hints:    &model.SelectHints{Step: 1000, MaxPerStep: 1, MaxValue: value(4.05)},
+			matchers: [][]*labels.Matcher{worker},
+			want:     []model.SeriesExemplars{keep(data[4], 0)},
+		},
+
+		{name: "descending", hints: &model.SelectHints{Descending: true}, matchers: [][]*labels.Matcher{all}, want: data},
+		{name: "thinned descending", hints: &model.SelectHints{Step: 1, MaxPerStep: 1, Descending: true}, matchers: [][]*labels.Matcher{all}, want: data},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _, err := s.Select(ctx, 0, 1000, tc.hints, tc.matchers...)
+			if err != nil {
+				t.Fatalf("select: %v", err)
+			}
+			requireOrderedResults(t, sortedSeries(tc.want, tc.hints != nil && tc.hints.Descending), got)
+		})
+	}
+}
+
+// testAppendSingle checks that exemplars appended one by one are the same
+// as appended in a batch.
+func testAppendSingle(t *testing.T, s storage.ExemplarStore) {
+	ctx := context.Background()
+	data := testData()
+	for _, se := range data {
+		for _, e := range se.Exemplars {
+			if err := s.AppendExemplar(ctx, se.Labels, e); err != nil {
+				t.Fatalf("append exemplar: %v", err)
+			}
+		}
+	}
+
+	got, _, err := s.Select(ctx, 0, 1000, nil, []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+")})
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	requireResults(t, data, got)
+}
+
+// testTimeBounds checks that start and end are inclusive.
+func testTimeBounds(t *testing.T, s storage.ExemplarStore) {
+	ctx := context.Background()
+	lset := labels.FromStrings(labels.MetricName, "bounds")
+	var exemplars []exemplar.Exemplar
+	for ts := int64(100); ts <= 500; ts += 100 {
+		exemplars = append(exemplars, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", fmt.Sprint(ts)), Value: float64(ts), Ts: ts, HasTs: true})
+	}
+	appendAll(ctx, t, s, []model.SeriesExemplars{{Labels: lset, Exemplars: exemplars}})
+
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "bounds")}
+	for _, tc := range []struct {
+		start, end int64
+		want       []exemplar.Exemplar
+	}{
+		{start: 0, end: 1000, want: exemplars},
+		{start: 200, end: 400, want: exemplars[1:4]},
+		{start: 201, end: 399, want: exemplars[2:3]},
+		{start: 300, end: 300, want: exemplars[2:3]},
+		{start: 500, end: 1000, want: exemplars[4:]},
+		{start: 0, end: 100, want: exemplars[:1]},
+		{start: 501, end: 1000},
+		{start: 0, end: 99},
+	} {
+		t.Run(fmt.Sprintf("%d-%d", tc.start, tc.end), func(t *testing.T) {
+			got, _, err := s.Select(ctx, tc.start, tc.end, nil, matchers)
+			if err != nil {
+				t.Fatalf("select: %v", err)
+			}
+			var want []model.SeriesExemplars
+			if len(tc.want) > 0 {
+				want = []model.SeriesExemplars{{Labels: lset, Exemplars: tc.want}}
+			}
+			requireResults(t, want, got)
+		})
+	}
+}
+
+// testMatcherSemantics checks series and exemplar matchers against
+// labels.Matcher.Matches: absent labels match like empty values and regexes
+// are anchored. The label foo is only set on some series, appended in
+// separate batches, and the label missing on none of them. Regexes that
+// stores may rewrite, like alternations of literals and prefixes, are
+// checked as well.
+func testMatcherSemantics(t *testing.T, s storage.ExemplarStore) {
+	ctx := context.Background()
+	var data []model.SeriesExemplars
+	for i, foo := range []string{"", "bar", "baz", "foobar", "ar", "ba\nz", "BAR"} {
+		lset := labels.FromStrings(labels.MetricName, "semantics", "instance", fmt.Sprint(i))
+		elset := labels.FromStrings("trace_id", fmt.Sprintf("%032x", i))
+		if foo != "" {
+			lset = labels.FromStrings(labels.MetricName, "semantics", "instance", fmt.Sprint(i), "foo", foo)
+			elset = labels.FromStrings("foo", foo, "trace_id", fmt.Sprintf("%032x", i))
+		}
+		se := model.SeriesExemplars{Labels: lset, Exemplars: []exemplar.Exemplar{{Labels: elset, Value: float64(i), Ts: int64(100 + i), HasTs: true}}}
+		appendAll(ctx, t, s, []model.SeriesExemplars{se})
+		data = append(data, se)
+	}
+
+	name := labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "semantics")
+	for _, m := range []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "foo", ""),
+		labels.MustNewMatcher(labels.MatchEqual, "foo", "bar"),
+		labels.MustNewMatcher(labels.MatchNotEqual, "foo", ""),
+		labels.MustNewMatcher(labels.MatchNotEqual, "foo", "bar"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", ""),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "ar"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "ba."),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "bar|"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", ".*"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", ".+"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "(?s).+"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "bar|baz"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "bar|ar|missing"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", `bar|ba\.`),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "(?i)bar|baz"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "(bar|baz)"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "ba.*"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "(?s)ba.*"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "ba.+"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "(?i)ba.*"),
+		labels.MustNewMatcher(labels.MatchRegexp, "foo", "fo.*"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "foo", ""),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "foo", "ar"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "foo", "ba."),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "foo", ".+"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "foo", "bar|baz"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "foo", "|bar|baz"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "foo", "ba.*"),
+		labels.MustNewMatcher(labels.MatchEqual, "missing", ""),
+		labels.MustNewMatcher(labels.MatchEqual, "missing", "bar"),
+		labels.MustNewMatcher(labels.MatchNotEqual, "missing", ""),
+		labels.MustNewMatcher(labels.MatchNotEqual, "missing", "bar"),
+		labels.MustNewMatcher(labels.MatchRegexp, "missing", ".*"),
+		labels.MustNewMatcher(labels.MatchRegexp, "missing", ".+"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "missing", ".+"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "missing", "bar"),
+		labels.MustNewMatcher(labels.MatchRegexp, "missing", "bar|baz"),
+		labels.MustNewMatcher(labels.MatchRegexp, "missing", "ba.*"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "missing", "|bar"),
+	} {
+		t.Run(m.String(), func(t *testing.T) {
+			var wantSeries, wantExemplars []model.SeriesExemplars
+			for _, se := range data {
+				if m.Matches(se.Labels.Get(m.Name)) {
+					wantSeries = append(wantSeries, se)
+				}
+				if m.Matches(se.Exemplars[0].Labels.Get(m.Name)) {
+					wantExemplars = append(wantExemplars, se)
+				}
+			}
+
+			t.Run("series", func(t *testing.T) {
+				got, _, err := s.Select(ctx, 0, 1000, nil, []*labels.Matcher{name, m})
+				if err != nil {
+					t.Fatalf("select: %v", err)
+				}
+				requireResults(t, wantSeries, got)
+			})
+			t.Run("series without other matchers", func(t *testing.T) {
+				got, _, err := s.Select(ctx, 0, 1000, nil, []*labels.Matcher{m})
+				if err != nil {
+					t.Fatalf("select: %v", err)
+				}
+				requireResults(t, wantSeries, got)
+			})
+			t.Run("exemplars", func(t *testing.T) {
+				hints := &model.SelectHints{ExemplarMatchers: [][]*labels.Matcher{{m}}}
+				got, _, err := s.Select(ctx, 0, 1000, hints, []*labels.Matcher{name})
+				if err != nil {
+					t.Fatalf("select: %v", err)
+				}
+				requireResults(t, wantExemplars, got)
+			})
+		})
+	}
+}
+
+// testLimits checks that selects exceeding a limit fail with a
+// *model.LimitError, or are truncated with a warning.
+func testLimits(t *testing.T, s storage.ExemplarStore) {
+	ctx := context.Background()
+	appendTestData(t, s)
+
+	all := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+")}
+	for _, tc := range []struct {
+		name   string
+		limits model.Limits
+		// step thins the selected exemplars to one per step if set.
+		step int64
+		// wantLimit is the limit expected to be reached, none if empty.
+		wantLimit string
+		// wantSeries is the number of series expected, any if 0.
+		wantSeries    int
+		wantExemplars int
+	}{
+		{name: "within limits", limits: model.Limits{MaxSeries: 5, MaxExemplars: 15, MaxBytes: 1 << 20}, wantSeries: 5, wantExemplars: 15},
+		{name: "series", limits: model.Limits{MaxSeries: 2}, wantLimit: "series"},
+		{name: "exemplars", limits: model.Limits{MaxExemplars: 14}, wantLimit: "exemplars"},
+		{name: "bytes", limits: model.Limits{MaxBytes: 100}, wantLimit: "bytes"},
+		{name: "truncated series", limits: model.Limits{MaxSeries: 2, Truncate: true}, wantLimit: "series", wantSeries: 2, wantExemplars: 6},
+		{name: "truncated exemplars", limits: model.Limits{MaxExemplars: 4, Truncate: true}, wantLimit: "exemplars", wantExemplars: 4},
+		// Exemplars are 10ms apart, a step of 5 keeps all of them.
+		{name: "thinned within limits", limits: model.Limits{MaxExemplars: 15}, step: 5, wantSeries: 5, wantExemplars: 15},
+		{name: "thinned exemplars", limits: model.Limits{MaxExemplars: 4}, step: 5, wantLimit: "exemplars"},
+		{name: "thinned series", limits: model.Limits{MaxSeries: 2}, step: 5, wantLimit: "series"},
+		{name: "truncated thinned exemplars", limits: model.Limits{MaxExemplars: 4, Truncate: true}, step: 5, wantLimit: "exemplars", wantExemplars: 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hints := &model.SelectHints{Limits: tc.limits}
+			if tc.step > 0 {
+				hints.Step, hints.MaxPerStep = tc.step, 1
+			}
+			got, warnings, err := s.Select(ctx, 0, 1000, hints, all)
+			if tc.wantLimit != "" && !tc.limits.Truncate {
+				requireLimitError(t, tc.wantLimit, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("select: %v", err)
+			}
+			if wantWarnings := tc.wantLimit != ""; (len(warnings) > 0) != wantWarnings {
+				t.Fatalf("unexpected warnings %v", warnings)
+			}
+			numExemplars := 0
+			for _, r := range got {
+				numExemplars += len(r.Exemplars)
+			}
+			if (tc.wantSeries > 0 && len(got) != tc.wantSeries) || numExemplars != tc.wantExemplars {
+				t.Fatalf("expected %d series with %d exemplars, got %d series with %d exemplars", tc.wantSeries, tc.wantExemplars, len(got), numExemplars)
+			}
+		})
+	}
+}
+
+// testSelectStream checks that SelectStream passes the series of Select in
+// the same order, and stops on the first error of the callback.
+func testSelectStream(t *testing.T, s storage.ExemplarStore) {
+	ctx := context.Background()
+	data := appendTestData(t, s)
+
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+")}
+	hints := &model.SelectHints{Descending: true}
+
+	t.Run("all", func(t *testing.T) {
+		var got []exemplar.QueryResult
+		_, err := s.SelectStream(ctx, 0, 1000, hints, func(r exemplar.QueryResult) error {
+			got = append(got, r)
+			return nil
+		}, matchers)
+		if err != nil {
+			t.Fatalf("select stream: %v", err)
+		}
+		requireOrderedResults(t, sortedSeries(data, true), got)
+	})
+	t.Run("error", func(t *testing.T) {
+		errStop := errors.New("stop")
+		calls := 0
+		_, err := s.SelectStream(ctx, 0, 1000, hints, func(r exemplar.QueryResult) error {
+			calls++
+			return errStop
+		}, matchers)
+		if !errors.Is(err, errStop) {
+			t.Fatalf("expected the error of the callback, got %v", err)
+		}
+		if calls != 1 {
+			t.Fatalf("expected a single call, got %d", calls)
+		}
+	})
+}
+
+// testSelectTopK checks that the exemplars with the highest values are
+// returned in descending order, across all series and per series, and that
+// the kept exemplars are bounded by the limits of the hints.
+func testSelectTopK(t *testing.T, s storage.ExemplarStore) {
+	ctx := context.Background()
+	data := appendTestData(t, s)
+
+	desc := func(se model.SeriesExemplars, n int) model.SeriesExemplars {
+		res := model.SeriesExemplars{Labels: se.Labels}
+		for i := len(se.Exemplars) - 1; i >= len(se.Exemplars)-n; i-- {
+			res.Exemplars = append(res.Exemplars, se.Exemplars[i])
+		}
+		return res
+	}
+	all := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+")}
+	maxValue := 4.05
+	for _, tc := range []struct {
+		name      string
+		k         int
+		perSeries bool
+		hints     *model.SelectHints
+		matchers  [][]*labels.Matcher
+		want      []model.SeriesExemplars
+		// wantLimit is the limit expected to be reached, none if empty.
+		wantLimit string
+	}{
+		{name: "global", k: 4, matchers: [][]*labels.Matcher{all}, want: []model.SeriesExemplars{
+			desc(data[4], 3), desc(data[3], 1),
+		}},
+		{name: "global more than available", k: 100, matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "job", "rpc")}}, want: []model.SeriesExemplars{
+			desc(data[3], 3),
+		}},
+		{name: "per series", k: 2, perSeries: true, matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "job", "api")}}, want: []model.SeriesExemplars{
+			desc(data[2], 2), desc(data[1], 2), desc(data[0], 2),
+		}},
+		{
+			name: "overlapping selectors", k: 2,
+			matchers: [][]*labels.Matcher{all, {labels.MustNewMatcher(labels.MatchEqual, "job", "worker")}},
+			want:     []model.SeriesExemplars{desc(data[4], 2)},
+		},
+		{
+			name: "value range", k: 2, hints: &model.SelectHints{MaxValue: &maxValue},
+			matchers: [][]*labels.Matcher{all},
+			want:     []model.SeriesExemplars{{Labels: data[4].Labels, Exemplars: data[4].Exemplars[:1]}, {Labels: data[3].Labels, Exemplars: data[3].Exemplars[2:]}},
+		},
+		{
+			name: "within limits", k: 2, perSeries: true, hints: &model.SelectHints{Limits: model.Limits{MaxSeries: 3, MaxExemplars: 6, MaxBytes: 1 << 20}},
+			matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "job", "api")}},
+			want:     []model.SeriesExemplars{desc(data[2], 2), desc(data[1], 2), desc(data[0], 2)},
+		},
+		{
+			name: "series limit", k: 1, perSeries: true, hints: &model.SelectHints{Limits: model.Limits{MaxSeries: 2}},
+			matchers: [][]*labels.Matcher{all}, wantLimit: "series",
+		},
+		{
+			name: "exemplars limit", k: 4, hints: &model.SelectHints{Limits: model.Limits{MaxExemplars: 3, Truncate: true}},
+			matchers: [][]*labels.Matcher{all}, wantLimit: "exemplars",
+		},
+		{
+			name: "bytes limit", k: 4, hints: &model.SelectHints{Limits: model.Limits{MaxBytes: 50}},
+			matchers: [][]*labels.Matcher{all}, wantLimit: "bytes",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.SelectTopK(ctx, 0, 1000, tc.k, tc.perSeries, tc.hints, tc.matchers...)
+			if tc.wantLimit != "" {
+				requireLimitError(t, tc.wantLimit, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("select top k: %v", err)
+			}
+			requireOrderedResults(t, tc.want, got)
+		})
+	}
+}
+
+// testSelectDensity checks that exemplars are counted per series and step
+// bucket aligned to multiples of the step, and that quantiles of their
+// values are computed per bucket. The series, buckets and values kept for
+// quantiles are bounded by the limits of the hints, even if they allow
+// truncation.
+func testSelectDensity(t *testing.T, s storage.ExemplarStore) {
+	ctx := context.Background()
+	data := appendTestData(t, s)
+
+	// With a step of 20, the first two exemplars of every series fall into
+	// the bucket at 100, the third one into the bucket at 120.
+	all := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+")}
+	rpc := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "rpc")}
+	maxValue := 4.05
+	for _, tc := range []struct {
+		name      string
+		start     int64
+		quantiles []float64
+		hints     *model.SelectHints
+		matchers  [][]*labels.Matcher
+		want      []string
+		// wantLimit is the limit expected to be reached, none if empty.
+		wantLimit string
+	}{
+		{name: "counts", matchers: [][]*labels.Matcher{all}, want: []string{
+			data[0].Labels.String() + " 100:2 120:1",
+			data[1].Labels.String() + " 100:2 120:1",
+			data[2].Labels.String() + " 100:2 120:1",
+			data[3].Labels.String() + " 100:2 120:1",
+			data[4].Labels.String() + " 100:2 120:1",
+		}},
+		{name: "quantiles", quantiles: []float64{0, 0.5, 1}, matchers: [][]*labels.Matcher{rpc}, want: []string{
+			data[3].Labels.String() + " 100:2[0=3,0.5=3.05,1=3.1] 120:1[0=3.2,0.5=3.2,1=3.2]",
+		}},
+		{name: "start within bucket", start: 110, matchers: [][]*labels.Matcher{rpc}, want: []string{
+			data[3].Labels.String() + " 100:1 120:1",
+		}},
+		{
+			name: "overlapping selectors", matchers: [][]*labels.Matcher{all, rpc},
+			hints: &model.SelectHints{ExemplarMatchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "trace_id", fmt.Sprintf("%032x", 31))}}},
+			want:  []string{data[3].Labels.String() + " 100:1"},
+		},
+		{
+			name: "value range", hints: &model.SelectHints{MaxValue: &maxValue},
+			matchers: [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "job", "worker")}},
+			want:     []string{data[4].Labels.String() + " 100:1"},
+		},
+		{
+			name: "quantiles within limits", quantiles: []float64{0.5}, matchers: [][]*labels.Matcher{rpc},
+			hints: &model.SelectHints{Limits: model.Limits{MaxSeries: 1, MaxExemplars: 5, MaxBytes: 1 << 20}},
+			want:  []string{data[3].Labels.String() + " 100:2[0.5=3.05] 120:1[0.5=3.2]"},
+		},
+		{
+			name: "series limit", matchers: [][]*labels.Matcher{all},
+			hints: &model.SelectHints{Limits: model.Limits{MaxSeries: 4}}, wantLimit: "series",
+		},
+		{
+			name: "buckets limit", matchers: [][]*labels.Matcher{all},
+			hints: &model.SelectHints{Limits: model.Limits{MaxExemplars: 9, Truncate: true}}, wantLimit: "exemplars",
+		},
+		{
+			name: "quantile values limit", quantiles: []float64{0.5}, matchers: [][]*labels.Matcher{all},
+			hints: &model.SelectHints{Limits: model.Limits{MaxExemplars: 14, Truncate: true}}, wantLimit: "exemplars",
+		},
+		{
+			name: "quantile bytes limit", quantiles: []float64{0.5}, matchers: [][]*labels.Matcher{all},
+			hints: &model.SelectHints{Limits: model.Limits{MaxBytes: 100}}, wantLimit: "bytes",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.SelectDensity(ctx, tc.start, 1000, 20, tc.quantiles, tc.hints, tc.matchers...)
+			if tc.wantLimit != "" {
+				requireLimitError(t, tc.wantLimit, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("select density: %v", err)
+			}
+			gotStr := make([]string, 0, len(got))
+			for _, sd := range got {
+				gotStr = append(gotStr, densityString(sd))
+			}
+			sort.Strings(gotStr)
+			sort.Strings(tc.want)
+			if w, g := strings.Join(tc.want, "\n"), strings.Join(gotStr, "\n"); w != g {
+				t.Fatalf("unexpected result\nwant:\n%s\ngot:\n%s", w, g)
+			}
+		})
+	}
+}
+
+// testSelectByTraceID checks that all exemplars carrying a trace ID are
+// found, across series and only within the time range, unless they exceed
+// the limits.
+func testSelectByTraceID(t *testing.T, s storage.ExemplarStore) {
+	ctx := context.Background()
+	data := appendTestData(t, s)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traced := func(ts int64, lset labels.Labels) exemplar.Exemplar {
+		return exemplar.Exemplar{Labels: lset, Value: float64(ts), Ts: ts, HasTs: true}
+	}
+	a := model.SeriesExemplars{Labels: data[0].Labels, Exemplars: []exemplar.Exemplar{
+		traced(200, labels.FromStrings("trace_id", traceID)),
+		traced(210, labels.FromStrings("span_id", "00f067aa0ba902b7", "trace_id", traceID)),
+	}}
+	b := model.SeriesExemplars{Labels: data[3].Labels, Exemplars: []exemplar.Exemplar{
+		traced(220, labels.FromStrings("trace_id", traceID)),
+		traced(230, labels.FromStrings("traceID", traceID)),
+	}}
+	appendAll(ctx, t, s, []model.SeriesExemplars{a, b})
+
+	for _, tc := range []struct {
+		name       string
+		start, end int64
+		label      string
+		traceID    string
+		limits     model.Limits
+		want       []model.SeriesExemplars
+		// wantLimit is the limit expected to be reached, none if empty.
+		wantLimit string
+	}{
+		{name: "all", start: 0, end: 1000, label: "trace_id", traceID: traceID, want: []model.SeriesExemplars{
+			a, {Labels: b.Labels, Exemplars: b.Exemplars[:1]},
+		}},
+		{name: "time range", start: 210, end: 220, label: "trace_id", traceID: traceID, want: []model.SeriesExemplars{
+			{Labels: a.Labels, Exemplars: a.Exemplars[1:]}, {Labels: b.Labels, Exemplars: b.Exemplars[:1]},
+		}},
+		{name: "other label", start: 0, end: 1000, label: "traceID", traceID: traceID, want: []model.SeriesExemplars{
+			{Labels: b.Labels, Exemplars: b.Exemplars[1:]},
+		}},
+		{name: "unknown trace", start: 0, end: 1000, label: "trace_id", traceID: "0af7651916cd43dd8448eb211c80319c"},
+		{name: "unknown label", start: 0, end: 1000, label: "not_existing", traceID: traceID},
+		{
+			name: "within limits", start: 0, end: 1000, label: "trace_id", traceID: traceID, limits: model.Limits{MaxSeries: 2, MaxExemplars: 3},
+			want: []model.SeriesExemplars{a, {Labels: b.Labels, Exemplars: b.Exemplars[:1]}},
+		},
+		{name: "series limit", start: 0, end: 1000, label: "trace_id", traceID: traceID, limits: model.Limits{MaxSeries: 1}, wantLimit: "series"},
+		{name: "exemplars limit", start: 0, end: 1000, label: "trace_id", traceID: traceID, limits: model.Limits{MaxExemplars: 2, Truncate: true}, wantLimit: "exemplars"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.SelectByTraceID(ctx, tc.start, tc.end, tc.label, tc.traceID, tc.limits)
+			if tc.wantLimit != "" {
+				requireLimitError(t, tc.wantLimit, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("select by trace ID: %v", err)
+			}
+			requireResults(t, tc.want, got)
+		})
+	}
+}
+
+// testTenants checks that the exemplars of tenants are isolated from each
+// other and that requests without tenant use tenancy.DefaultTenant.
+func testTenants(t *testing.T, s storage.ExemplarStore) {
+	data := testData()
+	defaultCtx := context.Background()
+	tenantCtx := tenancy.InjectTenant(context.Background(), "team-a")
+	appendAll(defaultCtx, t, s, pick(data, 0, 1))
+	appendAll(tenantCtx, t, s, pick(data, 2, 3))
+
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+")}
+	for _, tc := range []struct {
+		ctx  context.Context
+		want []model.SeriesExemplars
+	}{
+		{ctx: defaultCtx, want: pick(data, 0, 1)},
+		{ctx: tenancy.InjectTenant(context.Background(), tenancy.DefaultTenant), want: pick(data, 0, 1)},
+		{ctx: tenantCtx, want: pick(data, 2, 3)},
+		{ctx: tenancy.InjectTenant(context.Background(), "team-b")},
+	} {
+		t.Run(tenancy.TenantFromContext(tc.ctx), func(t *testing.T) {
+			got, _, err := s.Select(tc.ctx, 0, 1000, nil, matchers)
+			if err != nil {
+				t.Fatalf("select: %v", err)
+			}
+			requireResults(t, tc.want, got)
+		})
+	}
+}
+
+// testCancellation checks that selects with a canceled context fail with
+// context.Canceled instead of returning partial results.
+func testCancellation(t *testing.T, s storage.ExemplarStore) {
+	appendTestData(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+")}
+	for _, tc := range []struct {
+		name     string
+		selectFn func() error
+	}{
+		{name: "Select", selectFn: func() error {
+			_, _, err := s.Select(ctx, 0, 1000, nil, matchers)
+			return err
+		}},
+		{name: "SelectTopK", selectFn: func() error {
+			_, err := s.SelectTopK(ctx, 0, 1000, 1, false, nil, matchers)
+			return err
+		}},
+		{name: "SelectDensity", selectFn: func() error {
+			_, err := s.SelectDensity(ctx, 0, 1000, 100, nil, nil, matchers)
+			return err
+		}},
+		{name: "SelectByTraceID", selectFn: func() error {
+			_, err := s.SelectByTraceID(ctx, 0, 1000, "trace_id", "a", model.Limits{})
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.selectFn(); !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected context.Canceled, got %v", err)
+			}
+		})
+	}
+}
+
+// testConcurrency appends and selects from multiple goroutines and checks
+// that no exemplar is lost.
+func testConcurrency(t *testing.T, s storage.ExemplarStore) {
+	const (
+		writers   = 8
+		batches   = 20
+		perSeries = 5
+	)
+	ctx := context.Background()
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "concurrent")}
+
+	var (
+		wg   sync.WaitGroup
+		mtx  sync.Mutex
+		want []model.SeriesExemplars
+		errs []error
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			lset := labels.FromStrings(labels.MetricName, "concurrent", "writer", fmt.Sprint(w))
+			var all []exemplar.Exemplar
+			for b := 0; b < batches; b++ {
+				exemplars := make([]exemplar.Exemplar, 0, perSeries)
+				for i := 0; i < perSeries; i++ {
+					ts := int64(b*perSeries + i + 1)
+					exemplars = append(exemplars, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", fmt.Sprintf("%d-%d", w, ts)), Value: float64(w), Ts: ts, HasTs: true})
+				}
+				err := s.AppendExemplars(ctx, []model.SeriesExemplars{{Labels: lset, Exemplars: exemplars}})
+				if err == nil {
+					_, _, err = s.Select(ctx, 0, 1000, nil, matchers)
+				}
+				if err != nil {
+					mtx.Lock()
+					errs = append(errs, err)
+					mtx.Unlock()
+					return
+				}
+				all = append(all, exemplars...)
+			}
+			mtx.Lock()
+			want = append(want, model.SeriesExemplars{Labels: lset, Exemplars: all})
+			mtx.Unlock()
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		t.Errorf("append or select: %v", err)
+	}
+	if len(errs) > 0 {
+		t.FailNow()
+	}
+
+	got, _, err := s.Select(ctx, 0, 1000, nil, matchers)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	requireResults(t, want, got)
+}
+
+func open(t *testing.T, newStore NewStoreFunc) storage.ExemplarStore {
+	t.Helper()
+	s := newStore(t)
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("close store: %v", err)
+		}
+	})
+	return s
+}
+
+func appendAll(ctx context.Context, t *testing.T, s storage.ExemplarAppender, series []model.SeriesExemplars) {
+	t.Helper()
+	if err := s.AppendExemplars(ctx, series); err != nil {
+		t.Fatalf("append exemplars: %v", err)
+	}
+}
+
+// appendTestData appends the series of testData and returns them.
+func appendTestData(t *testing.T, s storage.ExemplarAppender) []model.SeriesExemplars {
+	t.Helper()
+	data := testData()
+	appendAll(context.Background(), t, s, data)
+	return data
+}
+
+// testData returns series with a few exemplars each, with different sets of
+// series and exemplar labels.
+func testData() []model.SeriesExemplars {
+	series := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "http_request_duration_seconds_bucket", "job", "api", "instance", "a", "le", "0.5"),
+		labels.FromStrings(labels.MetricName, "http_request_duration_seconds_bucket", "job", "api", "instance", "a", "le", "1"),
+		labels.FromStrings(labels.MetricName, "http_request_duration_seconds_bucket", "job", "api", "instance", "a", "le", "+Inf"),
+		labels.FromStrings(labels.MetricName, "rpc_calls_total", "job", "rpc", "instance", "b"),
+		labels.FromStrings(labels.MetricName, "rpc_errors_total", "job", "worker", "instance", "c", "code", "500"),
+	}
+	res := make([]model.SeriesExemplars, 0, len(series))
+	for i, lset := range series {
+		se := model.SeriesExemplars{Labels: lset}
+		for j := 0; j < 3; j++ {
+			elset := labels.FromStrings("trace_id", fmt.Sprintf("%032x", i*10+j))
+			if j%2 == 1 {
+				elset = labels.FromStrings("trace_id", fmt.Sprintf("%032x", i*10+j), "span_id", fmt.Sprintf("%016x", j))
+			}
+			se.Exemplars = append(se.Exemplars, exemplar.Exemplar{
+				Labels: elset,
+				Value:  float64(i) + float64(j)/10,
+				Ts:     int64(100 + 10*j + i),
+				HasTs:  true,
+			})
+		}
+		res = append(res, se)
+	}
+	return res
+}
+
+func pick(series []model.SeriesExemplars, idx ...int) []model.SeriesExemplars {
+	res := make([]model.SeriesExemplars, 0, len(idx))
+	for _, i := range idx {
+		res = append(res, series[i])
+	}
+	return res
+}
+
+// requireResults fails the test if got doesn't contain exactly the series
+// and exemplars of want, ignoring their order.
+func requireResults(t *testing.T, want []model.SeriesExemplars, got []exemplar.QueryResult) {
+	t.Helper()
+	wantStr := make([]string, 0, len(want))
+	for _, se := range want {
+		wantStr = append(wantStr, seriesString(se.Labels, se.Exemplars))
+	}
+	gotStr := make([]string, 0, len(got))
+	for _, r := range got {
+		gotStr = append(gotStr, seriesString(r.SeriesLabels, r.Exemplars))
+	}
+	sort.Strings(wantStr)
+	sort.Strings(gotStr)
+	if w, g := strings.Join(wantStr, "\n"), strings.Join(gotStr, "\n"); w != g {
+		t.Fatalf("unexpected result\nwant:\n%s\ngot:\n%s", w, g)
+	}
+}
+
+// requireOrderedResults fails the test if got doesn't contain exactly the
+// series and exemplars of want, in the same order.
+func requireOrderedResults(t *testing.T, want []model.SeriesExemplars, got []exemplar.QueryResult) {
+	t.Helper()
+	var w, g strings.Builder
+	for _, se := range want {
+		w.WriteString(se.Labels.String() + "\n")
+		for _, e := range se.Exemplars {
+			fmt.Fprintf(&w, "  %d %s %g\n", e.Ts, e.Labels.String(), e.Value)
+		}
+	}
+	for _, r := range got {
+		g.WriteString(r.SeriesLabels.String() + "\n")
+		for _, e := range r.Exemplars {
+			fmt.Fprintf(&g, "  %d %s %g\n", e.Ts, e.Labels.String(), e.Value)
+		}
+	}
+	if w.String() != g.String() {
+		t.Fatalf("unexpected result\nwant:\n%s\ngot:\n%s", w.String(), g.String())
+	}
+}
+
+// sortedSeries returns the series sorted by labels and their exemplars
+// sorted by timestamp, in descending order if descending is true, like
+// Select returns them.
+func sortedSeries(series []model.SeriesExemplars, descending bool) []model.SeriesExemplars {
+	res := make([]model.SeriesExemplars, 0, len(series))
+	for _, se := range series {
+		exemplars := append([]exemplar.Exemplar(nil), se.Exemplars...)
+		sort.SliceStable(exemplars, func(i, j int) bool {
+			if descending {
+				return exemplars[i].Ts > exemplars[j].Ts
+			}
+			return exemplars[i].Ts < exemplars[j].Ts
+		})
+		res = append(res, model.SeriesExemplars{Labels: se.Labels, Exemplars: exemplars})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return labels.Compare(res[i].Labels, res[j].Labels) < 0
+	})
+	return res
+}
+
+// seriesString formats a series and its exemplars sorted by timestamp.
+// Duplicate exemplars are kept.
+func seriesString(lset labels.Labels, exemplars []exemplar.Exemplar) string {
+	lines := make([]string, 0, len(exemplars))
+	for _, e := range exemplars {
+		lines = append(lines, fmt.Sprintf("  %020d %s %g", e.Ts, e.Labels.String(), e.Value))
+	}
+	sort.Strings(lines)
+	return lset.String() + "\n" + strings.Join(lines, "\n")
+}
+
+// densityString formats the buckets of a series as ts:count, followed by
+// the quantiles if there are any.
+// requireLimitError fails the test if err isn't a *model.LimitError of
+// limit.
+func requireLimitError(t *testing.T, limit string, err error) {
+	t.Helper()
+	var limitErr *model.LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != limit {
+		t.Fatalf("expected %s limit error, got %v", limit, err)
+	}
+}
+
+func densityString(sd model.SeriesDensity) string {
+	var b strings.Builder
+	b.WriteString(sd.SeriesLabels.String())
+	for _, bucket := range sd.Buckets {
+		fmt.Fprintf(&b, " %d:%d", bucket.Ts, bucket.Count)
+		if len(bucket.Quantiles) == 0 {
+			continue
+		}
+		qs := make([]string, 0, len(bucket.Quantiles))
+		for _, q := range bucket.Quantiles {
+			qs = append(qs, fmt.Sprintf("%g=%.6g", q.Q, q.Value))
+		}
+		b.WriteString("[" + strings.Join(qs, ",") + "]")
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+	promstorage "github.com/prometheus/prometheus/storage"
+)
+
+// Errors returned by ValidateExemplar. Exemplars rejected with one of them
+// will never be accepted, so senders must not retry them.
+var (
+	ErrInvalidSeriesLabels   = errors.New("invalid series labels")
+	ErrInvalidExemplarLabels = errors.New("invalid exemplar labels")
+	ErrExemplarLabelLength   = fmt.Errorf("label length for exemplar exceeds maximum of %d UTF-8 characters", exemplar.ExemplarMaxLabelSetLength)
+	ErrOutOfBounds           = errors.New("exemplar timestamp out of bounds")
+	ErrTooOld                = errors.New("exemplar older than the retention")
+)
+
+// ValidateExemplar checks whether the exemplar of the given series can be
+// stored. Exemplars before minValidTime are rejected as too old, see
+// MinValidTime.
+func ValidateExemplar(lset labels.Labels, e exemplar.Exemplar, minValidTime int64) error {
+	if len(lset) == 0 || !validLabels(lset) {
+		return ErrInvalidSeriesLabels
+	}
+	if !validLabels(e.Labels) {
+		return ErrInvalidExemplarLabels
+	}
+
+	// Same limit as Prometheus, see exemplar.ExemplarMaxLabelSetLength.
+	labelSetLen := 0
+	for _, l := range e.Labels {
+		labelSetLen += utf8.RuneCountInString(l.Name)
+		labelSetLen += utf8.RuneCountInString(l.Value)
+	}
+	if labelSetLen > exemplar.ExemplarMaxLabelSetLength {
+		return ErrExemplarLabelLength
+	}
+
+	if e.Ts < 0 {
+		return ErrOutOfBounds
+	}
+	if e.Ts < minValidTime {
+		return ErrTooOld
+	}
+	return nil
+}
+
+// MinValidTime returns the timestamp of the oldest exemplar kept at now with
+// the given retention, math.MinInt64 if exemplars are kept forever.
+func MinValidTime(now time.Time, retention time.Duration) int64 {
+	if retention <= 0 {
+		return math.MinInt64
+	}
+	return timestamp.FromTime(now.Add(-retention))
+}
+
+// IsPermanent returns whether err is caused by the exemplar itself rather
+// than by the storage, meaning retrying the exemplar is pointless. This
+// includes the errors of the Prometheus circular exemplar storage used by
+// the MemoryExemplarStore.
+func IsPermanent(err error) bool {
+	for _, perr := range []error{
+		ErrInvalidSeriesLabels, ErrInvalidExemplarLabels, ErrExemplarLabelLength, ErrOutOfBounds, ErrTooOld,
+		promstorage.ErrOutOfOrderExemplar, promstorage.ErrDuplicateExemplar, promstorage.ErrExemplarLabelLength,
+	} {
+		if errors.Is(err, perr) {
+			return true
+		}
+	}
+	return false
+}
+
+func validLabels(lset labels.Labels) bool {
+	for i, l := range lset {
+		if !model.LabelName(l.Name).IsValid() || !model.LabelValue(l.Value).IsValid() {
+			return false
+		}
+		if i > 0 && lset[i-1].Name == l.Name {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/timestamp"
+)
+
+func TestValidateExemplar(t *testing.T) {
+	series := labels.FromStrings("__name__", "foo")
+	traceID := labels.FromStrings("trace_id", "abc")
+
+	for _, tc := range []struct {
+		name         string
+		lset         labels.Labels
+		exemplar     exemplar.Exemplar
+		minValidTime int64
+		want         error
+	}{
+		{name: "valid", lset: series, exemplar: exemplar.Exemplar{Labels: traceID, Ts: 1}},
+		{name: "zero timestamp", lset: series, exemplar: exemplar.Exemplar{Labels: traceID, Ts: 0}},
+		{name: "negative timestamp", lset: series, exemplar: exemplar.Exemplar{Labels: traceID, Ts: -1}, want: ErrOutOfBounds},
+		{name: "no series labels", lset: labels.EmptyLabels(), exemplar: exemplar.Exemplar{Labels: traceID, Ts: 1}, want: ErrInvalidSeriesLabels},
+		{name: "invalid series label name", lset: labels.FromStrings("0foo", "bar"), exemplar: exemplar.Exemplar{Labels: traceID, Ts: 1}, want: ErrInvalidSeriesLabels},
+		{name: "duplicate series label", lset: labels.Labels{{Name: "a", Value: "1"}, {Name: "a", Value: "2"}}, exemplar: exemplar.Exemplar{Labels: traceID, Ts: 1}, want: ErrInvalidSeriesLabels},
+		{name: "invalid exemplar label value", lset: series, exemplar: exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "\xff"), Ts: 1}, want: ErrInvalidExemplarLabels},
+		{
+			name:     "exemplar labels at length limit",
+			lset:     series,
+			exemplar: exemplar.Exemplar{Labels: labels.FromStrings("a", strings.Repeat("x", exemplar.ExemplarMaxLabelSetLength-1)), Ts: 1},
+		},
+		{
+			name:     "exemplar labels too long",
+			lset:     series,
+			exemplar: exemplar.Exemplar{Labels: labels.FromStrings("a", strings.Repeat("x", exemplar.ExemplarMaxLabelSetLength)), Ts: 1},
+			want:     ErrExemplarLabelLength,
+		},
+		{name: "at min valid time", lset: series, exemplar: exemplar.Exemplar{Labels: traceID, Ts: 100}, minValidTime: 100},
+		{name: "too old", lset: series, exemplar: exemplar.Exemplar{Labels: traceID, Ts: 99}, minValidTime: 100, want: ErrTooOld},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateExemplar(tc.lset, tc.exemplar, tc.minValidTime)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got error %v, want %v", err, tc.want)
+			}
+			if err != nil && !IsPermanent(err) {
+				t.Fatalf("validation error %v isn't permanent", err)
+			}
+		})
+	}
+}
+
+func TestMinValidTime(t *testing.T) {
+	now := time.Unix(1000, 0)
+	if got := MinValidTime(now, 0); got != math.MinInt64 {
+		t.Fatalf("got %d without retention, want math.MinInt64", got)
+	}
+	if got, want := MinValidTime(now, time.Minute), timestamp.FromTime(now.Add(-time.Minute)); got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+}
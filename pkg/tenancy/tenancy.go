@@ -0,0 +1,62 @@
+// Package tenancy resolves the tenant of HTTP and gRPC requests and passes it
+// to the storage through the request context.
+package tenancy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// DefaultTenantHeader is the header the tenant is read from, same as Thanos.
+	DefaultTenantHeader = "THANOS-TENANT"
+	// DefaultTenant is used for requests without a tenant.
+	DefaultTenant = "default-tenant"
+)
+
+var tenantRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
+
+type tenantContextKey struct{}
+
+// InjectTenant returns a copy of ctx carrying the given tenant.
+func InjectTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of ctx, or DefaultTenant if ctx has
+// none.
+func TenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantContextKey{}).(string); ok && tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// TenantFromGRPCMetadata returns the tenant of an incoming gRPC request. gRPC
+// metadata keys are lower case, so the header is looked up lower cased.
+func TenantFromGRPCMetadata(ctx context.Context, header string) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return DefaultTenant, nil
+	}
+	values := md.Get(strings.ToLower(header))
+	if len(values) == 0 || values[0] == "" {
+		return DefaultTenant, nil
+	}
+	if len(values) > 1 {
+		return "", fmt.Errorf("multiple tenants in metadata %q", header)
+	}
+	return values[0], ValidateTenant(values[0])
+}
+
+// ValidateTenant checks that the tenant can be used as a database name.
+func ValidateTenant(tenant string) error {
+	if !tenantRegexp.MatchString(tenant) || tenant == "." || tenant == ".." {
+		return fmt.Errorf("invalid tenant %q", tenant)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yeya24/exemplars-storage/pkg/objstore"
+	"github.com/yeya24/exemplars-storage/pkg/storage"
+	"github.com/yeya24/exemplars-storage/pkg/storage/frostdb"
+	"github.com/yeya24/exemplars-storage/pkg/storage/memory"
+)
+
+// storageFlags are the flags configuring the exemplar store, shared by all
+// commands opening it.
+type storageFlags struct {
+	storeType            *string
+	maxExemplars         *int64
+	dataDir              *string
+	enableWAL            *bool
+	activeMemorySize     *int64
+	granuleSize          *int64
+	blockPersistInterval *time.Duration
+	retention            *time.Duration
+	objstoreConfig       *string
+	objstoreConfigFile   *string
+}
+
+func registerStorageFlags(fs *flag.FlagSet) *storageFlags {
+	return &storageFlags{
+		storeType:            fs.String("storage.type", string(storage.FrostDBExemplarStore), "Exemplar store to use, frostdb or memory. The memory store keeps a fixed number of exemplars per tenant in memory only, like Prometheus."),
+		maxExemplars:         fs.Int64("storage.memory.max-exemplars", 100000, "Number of exemplars the memory store keeps per tenant, the oldest ones are overwritten once it is full."),
+		dataDir:              fs.String("storage.data-dir", "data", "Directory for the WAL and, without object storage configuration, the persisted blocks."),
+		enableWAL:            fs.Bool("storage.wal", true, "Write exemplars to a write-ahead log. Without it, exemplars not yet persisted in a block are lost on restart."),
+		activeMemorySize:     fs.Int64("storage.active-memory-size", 512*1024*1024, "Size in bytes of the in-memory active block of a tenant after which it is persisted."),
+		granuleSize:          fs.Int64("storage.granule-size", 1024*1024, "Size in bytes after which granules are split."),
+		blockPersistInterval: fs.Duration("storage.block-persist-interval", 0, "How long a block stays in memory before the next write persists it. 0 persists blocks only once they reach the active memory size."),
+		retention:            fs.Duration("retention", 0, "How long to keep exemplars. Blocks whose exemplars are all older than the retention are deleted. 0 keeps exemplars forever."),
+		objstoreConfig:       fs.String("objstore.config", "", "YAML object store configuration in the Thanos format to persist blocks to, see https://thanos.io/tip/thanos/storage.md. Also supports the INMEMORY type for testing. Blocks are persisted to the blocks directory in the data dir if not set."),
+		objstoreConfigFile:   fs.String("objstore.config-file", "", "Path to the YAML object store configuration, alternative to --objstore.config."),
+	}
+}
+
+func (f *storageFlags) newStore(logger log.Logger, tracer trace.Tracer, reg prometheus.Registerer) (storage.ExemplarStore, error) {
+	storeType := storage.ExemplarStoreType(*f.storeType)
+	if storeType == storage.MemoryExemplarStore {
+		return storage.NewExemplarStore(logger, tracer, reg, storeType, storage.Options{
+			Memory: memory.Options{MaxExemplars: *f.maxExemplars},
+		})
+	}
+
+	bucketConf := []byte(*f.objstoreConfig)
+	if *f.objstoreConfigFile != "" {
+		var err error
+		bucketConf, err = os.ReadFile(*f.objstoreConfigFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read object store configuration")
+		}
+	}
+	bkt, err := objstore.NewBucket(logger, bucketConf, reg, *f.dataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "create bucket")
+	}
+	return storage.NewExemplarStore(logger, tracer, reg, storeType, storage.Options{
+		FrostDB: frostdb.Options{
+			DataDir:              *f.dataDir,
+			EnableWAL:            *f.enableWAL,
+			ActiveMemorySize:     *f.activeMemorySize,
+			GranuleSize:          *f.granuleSize,
+			BlockPersistInterval: *f.blockPersistInterval,
+			Retention:            *f.retention,
+			Bucket:               bkt,
+		},
+	})
+}